@@ -0,0 +1,142 @@
+package ftl
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Patterns of paths to leave out when spooling a directory, one per line.
+const SPOOL_IGNORE_FILE = ".ftlignore"
+
+// readIgnorePatterns reads the ignore file at the root of dir, if there is
+// one. Blank lines and lines starting with '#' are skipped.
+func readIgnorePatterns(dir string) (patterns []string, err error) {
+	file, err := os.Open(filepath.Join(dir, SPOOL_IGNORE_FILE))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	err = scanner.Err()
+	return
+}
+
+// ignored reports whether relPath matches any of the patterns. A pattern
+// matches either the whole path relative to the spooled directory or its
+// last element, and a trailing '/' restricts it to directories.
+func ignored(patterns []string, relPath string, isDir bool) bool {
+	if relPath == SPOOL_IGNORE_FILE {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+
+		if match, _ := filepath.Match(pattern, relPath); match {
+			return true
+		}
+		if match, _ := filepath.Match(pattern, filepath.Base(relPath)); match {
+			return true
+		}
+	}
+	return false
+}
+
+// TarDirectory writes a gzipped tar of the contents of dir to w, leaving out
+// anything matched by the directory's ignore file.
+func TarDirectory(dir string, w io.Writer) error {
+	patterns, err := readIgnorePatterns(dir)
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if relPath == "." {
+			return nil
+		}
+
+		if ignored(patterns, relPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
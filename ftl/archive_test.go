@@ -0,0 +1,126 @@
+package ftl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_TarDirectory_ignore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"app.py", "app.pyc", "log/debug.log", "static/site.css", ".git/HEAD"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(name), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, SPOOL_IGNORE_FILE), []byte("# build junk\n*.pyc\nlog/\n.git\n"), 0644)
+
+	buf := new(bytes.Buffer)
+	err = TarDirectory(dir, buf)
+	if err != nil {
+		t.Fatal("Error from TarDirectory", err)
+	}
+
+	gr, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+
+	if strings.Join(names, " ") != "app.py static/ static/site.css" {
+		t.Error("Unexpected archive contents", names)
+	}
+}
+
+// testArchive builds a gzipped tar holding files, keyed by name.
+func testArchive(files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		tw.Write([]byte(files[name]))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func Test_ValidateArchive(t *testing.T) {
+	valid := testArchive(map[string]string{
+		"ftl.json":       `{"hooks": {"post-jump": {"command": ["bin/restart", "--graceful"], "timeout": "1m"}, "pre-jump": "migrate.sh"}, "min_version": "0.2"}`,
+		"bin/restart":    "#!/bin/sh\n",
+		"migrate.sh":     "#!/bin/sh\n",
+		"static/app.css": "",
+	})
+	err := ValidateArchive("test.tar.gz", bytes.NewReader(valid))
+	if err != nil {
+		t.Error("Expected valid archive", err)
+	}
+
+	missing := testArchive(map[string]string{
+		"ftl.json": `{"hooks": {"post-jump": {"command": ["bin/restart"]}}}`,
+	})
+	err = ValidateArchive("test.tar.gz", bytes.NewReader(missing))
+	if err == nil {
+		t.Error("Expected error for missing hook script")
+	}
+
+	broken := testArchive(map[string]string{
+		"ftl.json": `{"min_version": "next"}`,
+	})
+	err = ValidateArchive("test.tar.gz", bytes.NewReader(broken))
+	if err == nil {
+		t.Error("Expected error for invalid manifest")
+	}
+
+	err = ValidateArchive("test.tar.gz", bytes.NewReader(testArchive(map[string]string{"index.html": ""})))
+	if err != nil {
+		t.Error("Expected archive without manifest to be valid", err)
+	}
+}
+
+func Test_olderVersion(t *testing.T) {
+	for _, c := range []struct {
+		a, b  string
+		older bool
+	}{
+		{"0.2.6", "0.3", true},
+		{"0.2.6", "0.2.10", true},
+		{"0.2.6", "0.2.6", false},
+		{"0.3", "0.2.6", false},
+		{"1.0", "1", false},
+	} {
+		if olderVersion(c.a, c.b) != c.older {
+			t.Error("Wrong comparison of", c.a, c.b)
+		}
+	}
+}
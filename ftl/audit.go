@@ -0,0 +1,103 @@
+package ftl
+
+import (
+	"encoding/json"
+	"fmt"
+	"launchpad.net/goamz/s3"
+	"os"
+	"strings"
+	"time"
+)
+
+// Actions recorded in a package's master history
+const (
+	AUDIT_JUMP      = "jump"
+	AUDIT_JUMP_BACK = "jump-back"
+	AUDIT_PURGE     = "purge"
+	AUDIT_TAG       = "tag"
+)
+
+// AuditEntry records a change made to a package on master. Revision is the
+// revision jumped to, purged or tagged. Previous is the revision that was
+// current before a jump, or that a moved tag pointed to.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Channel  string    `json:"channel,omitempty"`
+	Revision string    `json:"revision"`
+	Previous string    `json:"previous,omitempty"`
+	Tag      string    `json:"tag,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Host     string    `json:"host,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+func (rr *RemoteRepository) auditPrefix(packageName string) string {
+	return rr.key(fmt.Sprintf("%s.history/", packageName))
+}
+
+// auditFilePath names an entry so keys sort by time. Like check-ins, it
+// avoids dots so it doesn't look like a revision.
+func (rr *RemoteRepository) auditFilePath(packageName string, entry *AuditEntry) string {
+	t := entry.Time
+	timestamp := t.Format("20060102T150405") + fmt.Sprintf("%09dZ", t.Nanosecond())
+	return rr.auditPrefix(packageName) + timestamp + "-" + unsafeKeyCharRe.ReplaceAllString(entry.Host, "_")
+}
+
+// audit records a change to a package on master. Entries are never
+// overwritten. Failing to record one doesn't fail the change, which has
+// already been made.
+func (rr *RemoteRepository) audit(packageName string, entry *AuditEntry) {
+	entry.Time = time.Now().UTC()
+	entry.Channel = rr.channel
+	entry.User = currentUser()
+	entry.Message = rr.Message
+	entry.Host, _ = os.Hostname()
+
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = rr.bucket.Put(rr.auditFilePath(packageName, entry), data, "application/json", s3.Private)
+	}
+	if err != nil {
+		fmt.Println("Failed to record history", err)
+	}
+}
+
+// AuditHistory returns every change recorded for the package on master, in
+// every channel, oldest first.
+func (rr *RemoteRepository) AuditHistory(packageName string) (entries []*AuditEntry, err error) {
+	prefix := rr.auditPrefix(packageName)
+	marker := ""
+	for {
+		listResp, e := rr.bucket.List(prefix, "", marker, 1000)
+		if e != nil {
+			err = fmt.Errorf("Failed listing history: %v", e)
+			return
+		}
+
+		for _, key := range listResp.Contents {
+			marker = key.Key
+
+			data, e := rr.getObject(key.Key)
+			if e != nil {
+				err = e
+				return
+			}
+			if data == nil {
+				continue
+			}
+
+			entry := &AuditEntry{}
+			e = json.Unmarshal(data, entry)
+			if e != nil {
+				fmt.Println("Ignoring bad history entry", strings.TrimPrefix(key.Key, rr.prefix), e)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+
+		if !listResp.IsTruncated || len(listResp.Contents) == 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package ftl
+
+import (
+	"encoding/json"
+	"fmt"
+	"launchpad.net/goamz/s3"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HostCheckIn is what a host reports about a package each time it syncs.
+// Failed names a revision the host jumped back from as it failed its health
+// check.
+type HostCheckIn struct {
+	Host     string    `json:"host"`
+	Revision string    `json:"revision"`
+	Failed   string    `json:"failed,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+var unsafeKeyCharRe = regexp.MustCompile("[^A-Za-z0-9_-]")
+
+// checkInPrefix names the channel the same way pointer files do, so no
+// channel, including one called default, can share the default's check-ins.
+func (rr *RemoteRepository) checkInPrefix(packageName string) string {
+	return rr.pointerFilePath(packageName, "checkin") + "/"
+}
+
+func (rr *RemoteRepository) checkInFilePath(packageName, host string) string {
+	// Host names are full of dots, which would make the key look like a
+	// revision when listing.
+	return rr.checkInPrefix(packageName) + unsafeKeyCharRe.ReplaceAllString(host, "_")
+}
+
+// CheckIn records the revision a host is running in this channel, and the
+// revision that failed its health check if there was one. Either may be nil.
+func (rr *RemoteRepository) CheckIn(packageName, host string, revision, failed *RevisionInfo) error {
+	checkIn := &HostCheckIn{Host: host, Time: time.Now().UTC()}
+	if revision != nil {
+		checkIn.Revision = revision.Name()
+	}
+	if failed != nil {
+		checkIn.Failed = failed.Name()
+	}
+
+	data, err := json.Marshal(checkIn)
+	if err != nil {
+		return err
+	}
+
+	err = rr.bucket.Put(rr.checkInFilePath(packageName, host), data, "application/json", s3.Private)
+	if err != nil {
+		return fmt.Errorf("Failed to put check-in: %v", err)
+	}
+	return nil
+}
+
+// ListCheckIns returns the latest check-in of every host in this channel.
+func (rr *RemoteRepository) ListCheckIns(packageName string) (checkIns []*HostCheckIn, err error) {
+	checkInPrefix := rr.checkInPrefix(packageName)
+	var keys []string
+	err = rr.listKeys(checkInPrefix, func(key s3.Key) {
+		// Older versions kept every channel under the default's prefix
+		if !strings.Contains(strings.TrimPrefix(key.Key, checkInPrefix), "/") {
+			keys = append(keys, key.Key)
+		}
+	})
+	if err != nil {
+		err = fmt.Errorf("Failed listing check-ins: %v", err)
+		return
+	}
+
+	for _, key := range keys {
+		data, e := rr.getObject(key)
+		if e != nil {
+			err = e
+			return
+		}
+		if data == nil {
+			continue
+		}
+
+		checkIn := &HostCheckIn{}
+		e = json.Unmarshal(data, checkIn)
+		if e != nil {
+			fmt.Println("Ignoring bad check-in", rr.name(key), e)
+			continue
+		}
+		checkIns = append(checkIns, checkIn)
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package ftl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Per-package settings for this host, kept in the package directory
+const PKG_CONFIG_FILE = "config.json"
+
+// PackageConfig holds host-side settings for a package, overriding ftl's
+// defaults. Timeouts are durations such as "90s" or "5m".
+type PackageConfig struct {
+	// How long any package script may run
+	HookTimeout string `json:"hook_timeout,omitempty"`
+
+	// How long specific package scripts may run, by script name
+	HookTimeouts map[string]string `json:"hook_timeouts,omitempty"`
+
+	// Who package scripts run as, by name or id, instead of the user in the
+	// revision's manifest. The group defaults to the user's.
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	// Whether to give the files of each revision to that user
+	Chown bool `json:"chown,omitempty"`
+}
+
+// PackageConfig reads the package's config file. A package without one gets
+// an empty config.
+func (lr *LocalRepository) PackageConfig(packageName string) (config *PackageConfig, err error) {
+	configPath := filepath.Join(lr.BasePath, packageName, PKG_CONFIG_FILE)
+	config = &PackageConfig{}
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		err = fmt.Errorf("Failed to parse %s: %v", configPath, err)
+	}
+	return
+}
+
+// scriptTimeout returns how long the named script of a package may run. The
+// package's config takes precedence over the timeout declared for the script
+// in its manifest, which takes precedence over our default.
+func (lr *LocalRepository) scriptTimeout(packageName, scriptName, declared string) (timeout time.Duration, err error) {
+	timeout = lr.ScriptTimeout
+
+	config, err := lr.PackageConfig(packageName)
+	if err != nil {
+		return
+	}
+
+	value := config.HookTimeouts[scriptName]
+	if value == "" {
+		value = config.HookTimeout
+	}
+	if value == "" {
+		value = declared
+	}
+	if value == "" {
+		return
+	}
+
+	timeout, err = time.ParseDuration(value)
+	if err != nil {
+		err = fmt.Errorf("Invalid timeout for %s script %s: %v", packageName, scriptName, err)
+	}
+	return
+}
@@ -0,0 +1,165 @@
+package ftl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Script run to check a revision is healthy after it's activated
+	PKG_SCRIPT_HEALTHCHECK = "healthcheck"
+
+	// File holding a URL, and optionally the status it should return, to
+	// check a revision is healthy after it's activated
+	PKG_HEALTHCHECK_URL = "healthcheck-url"
+)
+
+const (
+	HEALTHCHECK_ATTEMPTS = 5
+	HEALTHCHECK_INTERVAL = 2 * time.Second
+	HEALTHCHECK_TIMEOUT  = 10 * time.Second
+)
+
+// How long to wait between health check attempts. Tests shorten it.
+var healthCheckInterval = HEALTHCHECK_INTERVAL
+
+type HealthCheckError struct {
+	Revision   *RevisionInfo
+	Err        error
+	RolledBack bool
+}
+
+func (e *HealthCheckError) Error() string {
+	msg := fmt.Sprintf("Health check of %s failed: %v", e.Revision.Name(), e.Err)
+	if e.RolledBack {
+		msg += " (jumped back)"
+	}
+	return msg
+}
+
+// healthCheckURL reads the URL and expected status for the revision's HTTP
+// health check, from its manifest or healthcheck-url file. The file holds the
+// URL, optionally followed by the status, which defaults to 200. An empty url
+// means there is no HTTP check.
+func (lr *LocalRepository) healthCheckURL(revision *RevisionInfo) (url string, status int, err error) {
+	manifest, err := lr.readManifest(revision)
+	if err != nil {
+		return
+	}
+
+	if manifest != nil && manifest.HealthCheck != nil {
+		url, status = manifest.HealthCheck.URL, manifest.HealthCheck.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		return
+	}
+
+	urlPath := filepath.Join(lr.revisionPath(revision), "ftl", PKG_HEALTHCHECK_URL)
+	data, err := ioutil.ReadFile(urlPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return
+	}
+
+	url, status = fields[0], http.StatusOK
+	if len(fields) > 1 {
+		status, err = strconv.Atoi(fields[1])
+		if err != nil {
+			err = fmt.Errorf("Invalid status in %s: %v", urlPath, err)
+		}
+	}
+	return
+}
+
+func checkURL(url string, status int) error {
+	client := &http.Client{Timeout: HEALTHCHECK_TIMEOUT}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != status {
+		return fmt.Errorf("%s returned %d, expected %d", url, resp.StatusCode, status)
+	}
+	return nil
+}
+
+func (lr *LocalRepository) checkHealthOnce(revision *RevisionInfo) error {
+	err := lr.RunPackageScript(revision, PKG_SCRIPT_HEALTHCHECK)
+	if err != nil {
+		return err
+	}
+
+	url, status, err := lr.healthCheckURL(revision)
+	if err != nil || url == "" {
+		return err
+	}
+
+	return checkURL(url, status)
+}
+
+// CheckHealth runs the revision's health checks, retrying until they pass or
+// we run out of attempts. Revisions without health checks are healthy.
+func (lr *LocalRepository) CheckHealth(revision *RevisionInfo) (err error) {
+	for attempt := 1; attempt <= HEALTHCHECK_ATTEMPTS; attempt++ {
+		err = lr.checkHealthOnce(revision)
+		if err == nil {
+			return
+		}
+
+		fmt.Printf("Health check of %s failed (attempt %d of %d): %v\n", revision.Name(), attempt, HEALTHCHECK_ATTEMPTS, err)
+		if attempt < HEALTHCHECK_ATTEMPTS {
+			time.Sleep(healthCheckInterval)
+		}
+	}
+	return
+}
+
+func (lr *LocalRepository) unhealthyFilePath(packageName string) string {
+	return filepath.Join(lr.BasePath, packageName, "unhealthy")
+}
+
+// UnhealthyRevision returns the revision sync last found failing its health
+// check, or nil if there isn't one.
+func (lr *LocalRepository) UnhealthyRevision(packageName string) (revision *RevisionInfo, err error) {
+	data, err := ioutil.ReadFile(lr.unhealthyFilePath(packageName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	revision = revisionFromName(strings.TrimSpace(string(data)))
+	return
+}
+
+// SetUnhealthyRevision remembers the revision as failing its health check.
+// A nil revision forgets it.
+func (lr *LocalRepository) SetUnhealthyRevision(packageName string, revision *RevisionInfo) error {
+	filePath := lr.unhealthyFilePath(packageName)
+	if revision == nil {
+		err := os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return ioutil.WriteFile(filePath, []byte(revision.Name()+"\n"), 0644)
+}
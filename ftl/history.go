@@ -0,0 +1,205 @@
+package ftl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Actions recorded in a package's history
+const (
+	HISTORY_ADD       = "add"
+	HISTORY_REMOVE    = "remove"
+	HISTORY_JUMP      = "jump"
+	HISTORY_JUMP_BACK = "jump-back"
+)
+
+// HistoryEntry records something done to a package on this host. From and
+// To are the active revisions before and after a jump, or the revision added
+// or removed. Error is set if the action failed.
+type HistoryEntry struct {
+	Time     time.Time     `json:"time"`
+	Action   string        `json:"action"`
+	User     string        `json:"user,omitempty"`
+	SudoUser string        `json:"sudo_user,omitempty"`
+	Trigger  string        `json:"trigger,omitempty"`
+	From     string        `json:"from,omitempty"`
+	To       string        `json:"to,omitempty"`
+	Hooks    []*HookResult `json:"hooks,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// HookResult is the outcome of a package script run during an action.
+type HookResult struct {
+	Hook     string `json:"hook"`
+	Revision string `json:"revision"`
+	Status   string `json:"status"`
+}
+
+// Appends from parallel adds are serialized so lines don't interleave.
+var historyLock sync.Mutex
+
+func (lr *LocalRepository) historyFilePath(packageName string) string {
+	return filepath.Join(lr.BasePath, packageName, "history")
+}
+
+func (lr *LocalRepository) newHistoryEntry(action string, from, to *RevisionInfo) *HistoryEntry {
+	entry := &HistoryEntry{
+		Time:     time.Now().UTC(),
+		Action:   action,
+		User:     currentUser(),
+		SudoUser: os.Getenv("SUDO_USER"),
+		Trigger:  lr.Trigger,
+	}
+	if from != nil {
+		entry.From = from.Name()
+	}
+	if to != nil {
+		entry.To = to.Name()
+	}
+	return entry
+}
+
+func hookStatus(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if pse, ok := err.(*PackageScriptError); ok {
+		if pse.TimedOut {
+			return "timed out"
+		}
+		return fmt.Sprintf("exited %d", pse.WaitStatus.ExitStatus())
+	}
+	return err.Error()
+}
+
+// runHook runs a package script, noting the result in entry if it ran.
+func (lr *LocalRepository) runHook(entry *HistoryEntry, revision *RevisionInfo, hook string) error {
+	ran, err := lr.runPackageScript(revision, hook)
+	if ran {
+		entry.Hooks = append(entry.Hooks, &HookResult{hook, revision.Name(), hookStatus(err)})
+	}
+	return err
+}
+
+// recordHistory appends entry to the package's history. Failing to record
+// history doesn't fail the action.
+func (lr *LocalRepository) recordHistory(packageName string, entry *HistoryEntry, err error) {
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	data, e := json.Marshal(entry)
+	if e != nil {
+		fmt.Println("Failed to record history", e)
+		return
+	}
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	file, e := os.OpenFile(lr.historyFilePath(packageName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if e != nil {
+		fmt.Println("Failed to record history", e)
+		return
+	}
+	defer file.Close()
+
+	_, e = file.Write(append(data, '\n'))
+	if e != nil {
+		fmt.Println("Failed to record history", e)
+	}
+}
+
+// History returns the package's history, oldest first. Lines which can't be
+// parsed are skipped.
+func (lr *LocalRepository) History(packageName string) (entries []*HistoryEntry, err error) {
+	file, err := os.Open(lr.historyFilePath(packageName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		entry := &HistoryEntry{}
+		if e := json.Unmarshal(scanner.Bytes(), entry); e != nil {
+			fmt.Println("Ignoring bad history entry", e)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	err = scanner.Err()
+	return
+}
+
+// RecentRevisions returns up to n revisions the package has had active on
+// this host, most recent first and each only once, starting with the active
+// revision.
+func (lr *LocalRepository) RecentRevisions(packageName string, n int) (revisions []*RevisionInfo, err error) {
+	entries, err := lr.History(packageName)
+	if err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	add := func(revision *RevisionInfo) {
+		if revision != nil && !seen[revision.Name()] && len(revisions) < n {
+			seen[revision.Name()] = true
+			revisions = append(revisions, revision)
+		}
+	}
+
+	add(lr.GetCurrentRevision(packageName))
+	for i := len(entries) - 1; i >= 0 && len(revisions) < n; i-- {
+		entry := entries[i]
+		if (entry.Action != HISTORY_JUMP && entry.Action != HISTORY_JUMP_BACK) || entry.Error != "" {
+			continue
+		}
+
+		revision, e := NewRevisionInfo(entry.To)
+		if e == nil {
+			add(revision)
+		}
+	}
+	return
+}
+
+// Rollback jumps to the revision that was active the given number of
+// activations ago, counting each revision once.
+func (lr *LocalRepository) Rollback(packageName string, steps int) (revision *RevisionInfo, err error) {
+	if steps < 1 {
+		err = fmt.Errorf("Can't roll back %d steps", steps)
+		return
+	}
+
+	revisions, err := lr.RecentRevisions(packageName, steps+1)
+	if err != nil {
+		return
+	}
+
+	if len(revisions) <= steps {
+		err = fmt.Errorf("%s only has %d earlier revisions in its history", packageName, len(revisions)-1)
+		return
+	}
+
+	revision = revisions[steps]
+	_, err = os.Stat(lr.revisionPath(revision))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("Revision %s is no longer installed", revision.Name())
+		}
+		return
+	}
+
+	err = lr.Jump(revision)
+	return
+}
@@ -0,0 +1,136 @@
+package ftl
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Every hook a package can provide a script for, in the order they run
+var PKG_HOOKS = []string{
+	PKG_SCRIPT_POST_SYNC,
+	PKG_SCRIPT_PRE_JUMP,
+	PKG_SCRIPT_UN_JUMP,
+	PKG_SCRIPT_POST_JUMP,
+	PKG_SCRIPT_HEALTHCHECK,
+	PKG_SCRIPT_PRE_REMOVE,
+}
+
+// Scripts at the top of a revision named for their hook, as they were
+// originally documented. The post-spool hook was called post-sync.
+var rootHookFiles = map[string]string{
+	PKG_SCRIPT_POST_SYNC:   "post-sync.sh",
+	PKG_SCRIPT_PRE_JUMP:    "pre-jump.sh",
+	PKG_SCRIPT_UN_JUMP:     "un-jump.sh",
+	PKG_SCRIPT_POST_JUMP:   "post-jump.sh",
+	PKG_SCRIPT_HEALTHCHECK: "healthcheck.sh",
+	PKG_SCRIPT_PRE_REMOVE:  "pre-remove.sh",
+}
+
+// HookScript is a script found in a revision for one of its hooks.
+type HookScript struct {
+	Hook string
+
+	// Relative to the revision directory, unless OnHost
+	Path string
+	Args []string
+
+	// Whether the manifest declared a command on the host rather than a
+	// file in the revision
+	OnHost bool
+
+	// The timeout declared in the manifest, if any
+	Timeout string
+
+	// Whether the script was declared in the manifest
+	Declared bool
+
+	Exists     bool
+	Executable bool
+
+	// Only one script runs for each hook. Declared scripts take precedence,
+	// then those in ftl/, then those at the top of the revision.
+	Runs bool
+}
+
+// FindHooks returns every script in the revision for each hook, including
+// declared scripts which are missing.
+func (lr *LocalRepository) FindHooks(revision *RevisionInfo) (scripts []*HookScript, err error) {
+	manifest, err := lr.readManifest(revision)
+	if err != nil {
+		return
+	}
+
+	revPath := lr.revisionPath(revision)
+	for _, hook := range PKG_HOOKS {
+		var candidates []*HookScript
+		if manifest != nil && manifest.Hooks[hook] != nil {
+			mh := manifest.Hooks[hook]
+			candidates = append(candidates, &HookScript{
+				Hook:     hook,
+				Path:     filepath.Clean(mh.Command[0]),
+				Args:     mh.Command[1:],
+				Timeout:  mh.Timeout,
+				OnHost:   !mh.inRevision(),
+				Declared: true,
+			})
+		}
+		candidates = append(candidates,
+			&HookScript{Hook: hook, Path: filepath.Join("ftl", hook)},
+			&HookScript{Hook: hook, Path: rootHookFiles[hook]},
+		)
+
+		found := false
+		for _, script := range candidates {
+			if script.OnHost {
+				_, e := exec.LookPath(script.Path)
+				script.Exists = e == nil
+				script.Executable = script.Exists
+			} else if info, e := os.Stat(filepath.Join(revPath, script.Path)); e == nil && !info.IsDir() {
+				script.Exists = true
+				script.Executable = info.Mode()&0111 != 0
+			}
+
+			if !script.Exists && !script.Declared {
+				continue
+			}
+
+			if !found {
+				script.Runs = true
+				found = true
+			}
+			scripts = append(scripts, script)
+		}
+	}
+	return
+}
+
+// hookScript returns the script to run for the named hook, or nil if the
+// revision doesn't have one.
+func (lr *LocalRepository) hookScript(revision *RevisionInfo, hook string) (*HookScript, error) {
+	scripts, err := lr.FindHooks(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, script := range scripts {
+		if script.Hook != hook || !script.Runs {
+			continue
+		}
+
+		if !script.Exists {
+			return nil, fmt.Errorf("%s declares %s for hook %s, but it doesn't exist", revision.Name(), script.Path, hook)
+		}
+		return script, nil
+	}
+	return nil, nil
+}
+
+// command builds the command to run the script.
+func (script *HookScript) command(revPath string) *exec.Cmd {
+	if script.OnHost {
+		return exec.Command(script.Path, script.Args...)
+	}
+	return exec.Command(filepath.Join(revPath, script.Path), script.Args...)
+}
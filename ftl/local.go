@@ -10,32 +10,60 @@ import (
 	"sort"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const (
-	PKG_SCRIPT_POST_SYNC = "post-spool"
-	PKG_SCRIPT_PRE_JUMP  = "pre-jump"
-	PKG_SCRIPT_POST_JUMP = "post-jump"
-	PKG_SCRIPT_UN_JUMP   = "un-jump"
-	PKG_SCRIPT_CLEAN     = "clean"
+	PKG_SCRIPT_POST_SYNC  = "post-spool"
+	PKG_SCRIPT_PRE_JUMP   = "pre-jump"
+	PKG_SCRIPT_POST_JUMP  = "post-jump"
+	PKG_SCRIPT_UN_JUMP    = "un-jump"
+	PKG_SCRIPT_PRE_REMOVE = "pre-remove"
+
+	// Deprecated: never run. Use PKG_SCRIPT_PRE_REMOVE.
+	PKG_SCRIPT_CLEAN = "clean"
 )
 
 type LocalRepository struct {
 	BasePath string
+
+	// The ftl command, such as "sync" or "jump", on whose behalf package
+	// scripts are run. Passed to them as FTL_TRIGGER.
+	Trigger string
+
+	// How long package scripts may run, unless the package's config says
+	// otherwise. 0 means no limit.
+	ScriptTimeout time.Duration
 }
 
 type PackageScriptError struct {
 	WaitStatus syscall.WaitStatus
 	Script     string
 	Revision   *RevisionInfo
+
+	// The last lines the script output
+	Tail []string
+
+	// Whether the script was stopped for running too long
+	TimedOut bool
+	Timeout  time.Duration
 }
 
 func (e *PackageScriptError) Error() string {
-	return fmt.Sprintf("Package script %s:%s exited %d", e.Revision, e.Script, e.WaitStatus.ExitStatus())
+	var msg string
+	if e.TimedOut {
+		msg = fmt.Sprintf("Package script %s:%s timed out after %v", e.Revision.Name(), e.Script, e.Timeout)
+	} else {
+		msg = fmt.Sprintf("Package script %s:%s exited %d", e.Revision.Name(), e.Script, e.WaitStatus.ExitStatus())
+	}
+	if len(e.Tail) > 0 {
+		msg += "\n  " + strings.Join(e.Tail, "\n  ")
+	}
+	return msg
 }
 
 func NewLocalRepository(basePath string) (lr *LocalRepository) {
-	return &LocalRepository{basePath}
+	return &LocalRepository{BasePath: basePath, ScriptTimeout: PKG_SCRIPT_TIMEOUT}
 }
 
 func (lr *LocalRepository) ListPackages() (packageNames []string) {
@@ -56,7 +84,18 @@ func (lr *LocalRepository) ListPackages() (packageNames []string) {
 	}
 
 	for _, fileInfo := range localPackages {
-		packageNames = append(packageNames, fileInfo.Name())
+		name := fileInfo.Name()
+		if strings.HasPrefix(name, ".") {
+			// Our lock file, or something else hidden
+			continue
+		}
+
+		if !fileInfo.IsDir() || !ValidPackageName(name) {
+			fmt.Printf("Ignoring %s: not a valid package directory\n", filepath.Join(lr.BasePath, name))
+			continue
+		}
+
+		packageNames = append(packageNames, name)
 	}
 	return
 }
@@ -102,6 +141,10 @@ func (lr *LocalRepository) ListRevisions(packageName string) (localRevisions []*
 	return
 }
 
+func (lr *LocalRepository) revisionPath(revision *RevisionInfo) string {
+	return filepath.Join(lr.BasePath, revision.PackageName, "revs", revision.Revision)
+}
+
 func (lr *LocalRepository) currentRevisionFilePath(packageName string) string {
 	filePath := filepath.Join(lr.BasePath, packageName, "current")
 	return filePath
@@ -130,24 +173,34 @@ func (lr *LocalRepository) GetCurrentRevision(packageName string) *RevisionInfo
 	currentFilePath := lr.currentRevisionFilePath(packageName)
 	revisionName := revisionFromLinkPath(packageName, currentFilePath)
 
-	if revisionName != "" {
-		return NewRevisionInfo(revisionName)
+	return revisionFromName(revisionName)
+}
+
+func revisionFromName(revisionName string) *RevisionInfo {
+	if revisionName == "" {
+		return nil
 	}
 
-	return nil
+	revision, err := NewRevisionInfo(revisionName)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return revision
 }
 
 func (lr *LocalRepository) GetPreviousRevision(packageName string) *RevisionInfo {
 	previousFilePath := lr.previousRevisionFilePath(packageName)
 	revisionName := revisionFromLinkPath(packageName, previousFilePath)
-	if revisionName != "" {
-		return &RevisionInfo{packageName, revisionName}
-	}
-
-	return nil
+	return revisionFromName(revisionName)
 }
 
 func (lr *LocalRepository) Add(revision *RevisionInfo, fileName string, r io.Reader) (err error) {
+	entry := lr.newHistoryEntry(HISTORY_ADD, nil, revision)
+	defer func() {
+		lr.recordHistory(revision.PackageName, entry, err)
+	}()
+
 	revisionPath := filepath.Join(lr.BasePath, revision.PackageName, "revs", revision.Revision)
 	fmt.Println("Adding", revisionPath)
 
@@ -156,6 +209,13 @@ func (lr *LocalRepository) Add(revision *RevisionInfo, fileName string, r io.Rea
 		return
 	}
 
+	// Don't leave a revision that can't be used where it could be jumped to
+	defer func() {
+		if err != nil {
+			os.RemoveAll(revisionPath)
+		}
+	}()
+
 	revisionFilePath := filepath.Join(revisionPath, fileName)
 	w, err := os.Create(revisionFilePath)
 	if err != nil {
@@ -172,6 +232,11 @@ func (lr *LocalRepository) Add(revision *RevisionInfo, fileName string, r io.Rea
 	w.Close()
 
 	checkFile, err := os.Open(revisionFilePath)
+	if err != nil {
+		return
+	}
+	defer checkFile.Close()
+
 	hashPrefix, err := fileHashPrefix(checkFile)
 	if err != nil {
 		return
@@ -181,6 +246,18 @@ func (lr *LocalRepository) Add(revision *RevisionInfo, fileName string, r io.Rea
 		return fmt.Errorf("Checksum does not match")
 	}
 
+	manifest, _, err := readArchive(fileName, checkFile)
+	if err != nil {
+		return
+	}
+
+	if manifest != nil {
+		err = lr.checkManifest(revision, manifest)
+		if err != nil {
+			return
+		}
+	}
+
 	if strings.HasSuffix(fileName, ".tgz") || strings.HasSuffix(fileName, ".gz") {
 		cmd := exec.Command("gunzip", revisionFilePath)
 		err = cmd.Run()
@@ -190,24 +267,43 @@ func (lr *LocalRepository) Add(revision *RevisionInfo, fileName string, r io.Rea
 		}
 	}
 
-	revisionFilePrefix := filepath.Join(revisionPath, revision.Name())
+	// Archives must unpack, rather than leaving the archive behind as the
+	// revision's only file.
+	tarFilePath := ""
+	switch archiveSuffix(fileName) {
+	case "tgz":
+		tarFilePath = strings.TrimSuffix(revisionFilePath, ".tgz") + ".tar"
+	case "tar.gz":
+		tarFilePath = strings.TrimSuffix(revisionFilePath, ".gz")
+	case "tar":
+		tarFilePath = revisionFilePath
+	}
 
-	_, err = os.Stat(revisionFilePrefix + ".tar")
-	if err == nil {
-		cmd := exec.Command("tar", "-C", revisionPath, "-xf", revisionFilePrefix+".tar")
+	if tarFilePath != "" {
+		cmd := exec.Command("tar", "-C", revisionPath, "-xf", tarFilePath)
 		err = cmd.Run()
 		if err != nil {
-			fmt.Println("Failed to untar", err)
+			err = fmt.Errorf("Failed to untar %s: %v", filepath.Base(tarFilePath), err)
 			return
 		}
-		err = os.Remove(revisionFilePrefix + ".tar")
+		err = os.Remove(tarFilePath)
 		if err != nil {
 			fmt.Println("Failed to cleanup", err)
 			return
 		}
 	}
 
-	err = lr.RunPackageScript(revision, PKG_SCRIPT_POST_SYNC)
+	err = lr.linkShared(revision)
+	if err != nil {
+		return
+	}
+
+	err = lr.chownRevision(revision)
+	if err != nil {
+		return
+	}
+
+	err = lr.runHook(entry, revision, PKG_SCRIPT_POST_SYNC)
 	if err != nil {
 		return
 	}
@@ -215,12 +311,22 @@ func (lr *LocalRepository) Add(revision *RevisionInfo, fileName string, r io.Rea
 	return
 }
 
-func (lr *LocalRepository) Remove(revision *RevisionInfo) error {
+func (lr *LocalRepository) Remove(revision *RevisionInfo) (err error) {
 	activeRevision := lr.GetCurrentRevision(revision.PackageName)
 	if activeRevision != nil && *activeRevision == *revision {
 		return fmt.Errorf("Can't remove active revision")
 	}
 
+	entry := lr.newHistoryEntry(HISTORY_REMOVE, revision, nil)
+	defer func() {
+		lr.recordHistory(revision.PackageName, entry, err)
+	}()
+
+	err = lr.runHook(entry, revision, PKG_SCRIPT_PRE_REMOVE)
+	if err != nil {
+		return err
+	}
+
 	revFileName := filepath.Join(lr.BasePath, revision.PackageName, "revs", revision.Revision)
 	e := os.RemoveAll(revFileName)
 	if e != nil {
@@ -281,14 +387,24 @@ func (lr *LocalRepository) Jump(revision *RevisionInfo) (err error) {
 		}
 	}
 
-	err = lr.RunPackageScript(revision, PKG_SCRIPT_PRE_JUMP)
+	entry := lr.newHistoryEntry(HISTORY_JUMP, existingRevision, revision)
+	defer func() {
+		lr.recordHistory(revision.PackageName, entry, err)
+	}()
+
+	err = lr.RenderTemplates(revision)
+	if err != nil {
+		return
+	}
+
+	err = lr.runHook(entry, revision, PKG_SCRIPT_PRE_JUMP)
 	if err != nil {
 		return
 	}
 
 	currentLinkPath := lr.currentRevisionFilePath(revision.PackageName)
 	if existingRevision != nil {
-		err = lr.RunPackageScript(existingRevision, PKG_SCRIPT_UN_JUMP)
+		err = lr.runHook(entry, existingRevision, PKG_SCRIPT_UN_JUMP)
 		if err != nil {
 			return
 		}
@@ -315,15 +431,31 @@ func (lr *LocalRepository) Jump(revision *RevisionInfo) (err error) {
 		return
 	}
 
-	err = lr.RunPackageScript(revision, PKG_SCRIPT_POST_JUMP)
+	err = lr.runHook(entry, revision, PKG_SCRIPT_POST_JUMP)
 	if err != nil {
 		return
 	}
 
+	err = lr.CheckHealth(revision)
+	if err != nil {
+		healthErr := &HealthCheckError{Revision: revision, Err: err}
+		if existingRevision != nil {
+			fmt.Println("Jumping back to", existingRevision.Name())
+			jumpBackErr := lr.JumpBack(revision.PackageName)
+			if jumpBackErr != nil {
+				fmt.Println("Failed to jump back", jumpBackErr)
+			} else {
+				healthErr.RolledBack = true
+			}
+		}
+		err = healthErr
+		return
+	}
+
 	return
 }
 
-func (lr *LocalRepository) JumpBack(pkgName string) error {
+func (lr *LocalRepository) JumpBack(pkgName string) (err error) {
 	currentLinkPath := lr.currentRevisionFilePath(pkgName)
 	previousLinkPath := lr.previousRevisionFilePath(pkgName)
 
@@ -343,12 +475,22 @@ func (lr *LocalRepository) JumpBack(pkgName string) error {
 		return fmt.Errorf("Failed to read current version: %v", err)
 	}
 
-	err = lr.RunPackageScript(previousRevision, PKG_SCRIPT_PRE_JUMP)
+	entry := lr.newHistoryEntry(HISTORY_JUMP_BACK, currentRevision, previousRevision)
+	defer func() {
+		lr.recordHistory(pkgName, entry, err)
+	}()
+
+	err = lr.RenderTemplates(previousRevision)
 	if err != nil {
 		return err
 	}
 
-	err = lr.RunPackageScript(currentRevision, PKG_SCRIPT_UN_JUMP)
+	err = lr.runHook(entry, previousRevision, PKG_SCRIPT_PRE_JUMP)
+	if err != nil {
+		return err
+	}
+
+	err = lr.runHook(entry, currentRevision, PKG_SCRIPT_UN_JUMP)
 	if err != nil {
 		return err
 	}
@@ -373,7 +515,7 @@ func (lr *LocalRepository) JumpBack(pkgName string) error {
 		fmt.Println("Failed creating symlink", err)
 	}
 
-	err = lr.RunPackageScript(previousRevision, PKG_SCRIPT_POST_JUMP)
+	err = lr.runHook(entry, previousRevision, PKG_SCRIPT_POST_JUMP)
 	if err != nil {
 		return err
 	}
@@ -421,32 +563,87 @@ func (lr *LocalRepository) CheckPackage(packageName string) (err error) {
 	return
 }
 
-func (lr *LocalRepository) RunPackageScript(revision *RevisionInfo, scriptName string) (err error) {
-	cwd, _ := os.Getwd()
-	defer os.Chdir(cwd)
+// scriptEnv describes the revision and what is happening to it for package
+// scripts, so they don't need to work it out from their working directory.
+func (lr *LocalRepository) scriptEnv(revision *RevisionInfo, scriptName string) []string {
+	env := []string{
+		"FTL_PACKAGE=" + revision.PackageName,
+		"FTL_REVISION=" + revision.Name(),
+		"FTL_REVISION_PATH=" + lr.revisionPath(revision),
+		"FTL_ROOT=" + lr.BasePath,
+		"FTL_HOOK=" + scriptName,
+		"FTL_TRIGGER=" + lr.Trigger,
+	}
+
+	if current := lr.GetCurrentRevision(revision.PackageName); current != nil {
+		env = append(env, "FTL_CURRENT_REVISION="+current.Name())
+	}
+
+	if previous := lr.GetPreviousRevision(revision.PackageName); previous != nil {
+		env = append(env, "FTL_PREVIOUS_REVISION="+previous.Name())
+	}
+
+	return env
+}
+
+func (lr *LocalRepository) RunPackageScript(revision *RevisionInfo, scriptName string) error {
+	_, err := lr.runPackageScript(revision, scriptName)
+	return err
+}
 
-	revPath := filepath.Join(lr.BasePath, revision.PackageName, "revs", revision.Revision)
-	scriptPath := filepath.Join(revPath, "ftl", scriptName)
+// runPackageScript runs the named script if the revision has one, reporting
+// whether it did.
+func (lr *LocalRepository) runPackageScript(revision *RevisionInfo, scriptName string) (ran bool, err error) {
+	revPath := lr.revisionPath(revision)
+	script, err := lr.hookScript(revision, scriptName)
+	if err != nil || script == nil {
+		// Scripts aren't required
+		return
+	}
 
-	os.Chdir(revPath)
+	timeout, err := lr.scriptTimeout(revision.PackageName, scriptName, script.Timeout)
+	if err != nil {
+		return
+	}
 
-	_, err = os.Stat(scriptPath)
+	su, err := lr.scriptUser(revision)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// That's fine, script isn't required.
-			err = nil
-		}
 		return
 	}
 
-	cmd := exec.Command(scriptPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
-	if e, ok := err.(*exec.ExitError); ok {
-		if s, ok := e.Sys().(syscall.WaitStatus); ok {
-			err = &PackageScriptError{s, scriptName, revision}
+	log, err := newScriptLog(revPath, revision, scriptName)
+	if err != nil {
+		err = fmt.Errorf("Failed to open script log: %v", err)
+		return
+	}
+	defer log.Close()
+
+	stdout := log.Writer(os.Stdout)
+	stderr := log.Writer(os.Stderr)
+
+	cmd := script.command(revPath)
+	cmd.Dir = revPath
+	cmd.Env = os.Environ()
+	if su != nil {
+		cmd.Env = su.env(cmd.Env)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: su.credential()}
+	}
+	cmd.Env = append(cmd.Env, lr.scriptEnv(revision, scriptName)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	ran = true
+	timedOut, err := runScript(cmd, timeout)
+
+	stdout.Flush()
+	stderr.Flush()
+
+	// A script that timed out failed, even if it exited cleanly once stopped
+	if _, ok := err.(*exec.ExitError); ok || timedOut {
+		var s syscall.WaitStatus
+		if cmd.ProcessState != nil {
+			s, _ = cmd.ProcessState.Sys().(syscall.WaitStatus)
 		}
+		err = &PackageScriptError{s, scriptName, revision, log.Tail(), timedOut, timeout}
 	}
 	return
 }
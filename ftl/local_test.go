@@ -0,0 +1,739 @@
+package ftl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestLocal(t *testing.T) *LocalRepository {
+	basePath, err := ioutil.TempDir("", "ftl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Scripts report the directory they ran in, which may not be the path we
+	// built if the temp directory is behind a symlink.
+	basePath, err = filepath.EvalSymlinks(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewLocalRepository(basePath)
+}
+
+func addTestScript(t *testing.T, lr *LocalRepository, revision *RevisionInfo, scriptName, script string) {
+	scriptDir := filepath.Join(lr.revisionPath(revision), "ftl")
+	err := os.MkdirAll(scriptDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(scriptDir, scriptName), []byte("#!/bin/sh\n"+script+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_RunPackageScript_concurrent(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	cwd, _ := os.Getwd()
+
+	var revisions []*RevisionInfo
+	for i := 0; i < 8; i++ {
+		revision := &RevisionInfo{"pkg", fmt.Sprintf("140000000%dAb", i)}
+		addTestScript(t, lr, revision, PKG_SCRIPT_POST_SYNC, "sleep 0.1; pwd -P > ran_in")
+		revisions = append(revisions, revision)
+	}
+
+	var wg sync.WaitGroup
+	for _, revision := range revisions {
+		wg.Add(1)
+		go func(revision *RevisionInfo) {
+			defer wg.Done()
+			err := lr.RunPackageScript(revision, PKG_SCRIPT_POST_SYNC)
+			if err != nil {
+				t.Error(err)
+			}
+		}(revision)
+	}
+	wg.Wait()
+
+	for _, revision := range revisions {
+		data, err := ioutil.ReadFile(filepath.Join(lr.revisionPath(revision), "ran_in"))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		ranIn := strings.TrimSpace(string(data))
+		if ranIn != lr.revisionPath(revision) {
+			t.Error("Script for", revision.Name(), "ran in", ranIn)
+		}
+	}
+
+	if newCwd, _ := os.Getwd(); newCwd != cwd {
+		t.Error("Working directory changed to", newCwd)
+	}
+}
+
+func Test_RunPackageScript_timeout(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+	lr.ScriptTimeout = 100 * time.Millisecond
+
+	// Exits cleanly when asked to stop, but still ran too long
+	revision := &RevisionInfo{"pkg", "1400000000Ab"}
+	addTestScript(t, lr, revision, PKG_SCRIPT_POST_SYNC, "trap 'exit 0' TERM; sleep 30 & wait")
+
+	err := lr.RunPackageScript(revision, PKG_SCRIPT_POST_SYNC)
+	pse, ok := err.(*PackageScriptError)
+	if !ok || !pse.TimedOut {
+		t.Error("Expected timeout error", err)
+	}
+}
+
+func Test_RunPackageScript_rootLayout(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	revision := &RevisionInfo{"pkg", "1400000000Ab"}
+	revPath := lr.revisionPath(revision)
+	os.MkdirAll(revPath, 0755)
+	ioutil.WriteFile(filepath.Join(revPath, "post-sync.sh"), []byte("#!/bin/sh\ntouch ran\n"), 0755)
+
+	err := lr.RunPackageScript(revision, PKG_SCRIPT_POST_SYNC)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(revPath, "ran")); err != nil {
+		t.Error("post-sync.sh didn't run")
+	}
+}
+
+func Test_FindHooks_precedence(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	revision := &RevisionInfo{"pkg", "1400000000Ab"}
+	revPath := lr.revisionPath(revision)
+	addTestScript(t, lr, revision, PKG_SCRIPT_PRE_JUMP, "true")
+	addTestScript(t, lr, revision, PKG_SCRIPT_POST_JUMP, "true")
+	ioutil.WriteFile(filepath.Join(revPath, "pre-jump.sh"), []byte("#!/bin/sh\n"), 0755)
+	ioutil.WriteFile(filepath.Join(revPath, PKG_MANIFEST), []byte(`{"hooks": {"post-jump": "bin/restart"}}`), 0644)
+
+	scripts, err := lr.FindHooks(revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found []string
+	for _, script := range scripts {
+		found = append(found, fmt.Sprintf("%s %s %v", script.Hook, script.Path, script.Runs))
+	}
+
+	expected := []string{
+		"pre-jump ftl/pre-jump true",
+		"pre-jump pre-jump.sh false",
+		"post-jump bin/restart true",
+		"post-jump ftl/post-jump false",
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Error("Unexpected hooks", found)
+	}
+
+	err = lr.RunPackageScript(revision, PKG_SCRIPT_POST_JUMP)
+	if err == nil {
+		t.Error("Expected error for missing declared script")
+	}
+}
+
+func Test_parseManifest_invalid(t *testing.T) {
+	for _, data := range []string{
+		`{"hooks": {"post-sync": "x"}}`,
+		`{"hooks": {"pre-jump": "../x"}}`,
+		`{"hooks": {"pre-jump": "/bin/true"}}`,
+		`{"hooks": `,
+	} {
+		_, err := parseManifest([]byte(data))
+		if err == nil {
+			t.Error("Expected error for", data)
+		}
+	}
+}
+
+func Test_RunPackageScript_declaredCommand(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	revision := &RevisionInfo{"pkg", "1400000000Ab"}
+	revPath := lr.revisionPath(revision)
+	os.MkdirAll(revPath, 0755)
+	ioutil.WriteFile(filepath.Join(revPath, PKG_MANIFEST), []byte(`{"hooks": {"post-spool": {"command": ["sh", "-c", "touch $0", "ran"]}}}`), 0644)
+
+	err := lr.RunPackageScript(revision, PKG_SCRIPT_POST_SYNC)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(revPath, "ran")); err != nil {
+		t.Error("Declared command didn't run")
+	}
+}
+
+func Test_RunPackageScript_user(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Only root can run scripts as another user")
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("No nobody user")
+	}
+
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+	os.Chmod(lr.BasePath, 0755)
+
+	revision := &RevisionInfo{"pkg", "1400000000Ab"}
+	addTestScript(t, lr, revision, PKG_SCRIPT_POST_SYNC, "id -un > ftl/ran_as; echo \"$AWS_SECRET_ACCESS_KEY\" > ftl/secret")
+	ioutil.WriteFile(filepath.Join(lr.BasePath, "pkg", PKG_CONFIG_FILE), []byte(`{"user": "nobody", "chown": true}`), 0644)
+
+	err := lr.chownRevision(revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldSecret, hadSecret := os.LookupEnv("AWS_SECRET_ACCESS_KEY")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer func() {
+		if hadSecret {
+			os.Setenv("AWS_SECRET_ACCESS_KEY", oldSecret)
+		} else {
+			os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		}
+	}()
+
+	err = lr.RunPackageScript(revision, PKG_SCRIPT_POST_SYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(lr.revisionPath(revision), "ftl", "ran_as"))
+	if strings.TrimSpace(string(data)) != "nobody" {
+		t.Error("Script ran as", string(data))
+	}
+
+	info, err := os.Stat(lr.revisionPath(revision))
+	if err != nil || info.Sys().(*syscall.Stat_t).Uid != 0 {
+		t.Error("Expected the revision directory to stay ours", err)
+	}
+
+	data, _ = ioutil.ReadFile(filepath.Join(lr.revisionPath(revision), "ftl", "secret"))
+	if strings.TrimSpace(string(data)) != "" {
+		t.Error("Expected AWS credentials to be kept from the script", string(data))
+	}
+}
+
+func Test_RunPackageScript_logSymlink(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	revision := &RevisionInfo{"pkg", "1400000000Ab"}
+	addTestScript(t, lr, revision, PKG_SCRIPT_POST_SYNC, "echo INJECTED")
+
+	target := filepath.Join(lr.BasePath, "target")
+	ioutil.WriteFile(target, []byte("original\n"), 0644)
+	os.Symlink(target, filepath.Join(lr.revisionPath(revision), PKG_SCRIPT_LOG))
+
+	err := lr.RunPackageScript(revision, PKG_SCRIPT_POST_SYNC)
+	if err == nil {
+		t.Error("Expected error when the log is a symlink")
+	}
+
+	data, _ := ioutil.ReadFile(target)
+	if string(data) != "original\n" {
+		t.Error("Expected the symlink target to be untouched", string(data))
+	}
+}
+
+func Test_linkShared(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	manifest := []byte(`{"shared": ["log/", "tmp/uploads"]}`)
+
+	first := &RevisionInfo{"pkg", "1400000000Ab"}
+	firstPath := lr.revisionPath(first)
+	os.MkdirAll(filepath.Join(firstPath, "log"), 0755)
+	ioutil.WriteFile(filepath.Join(firstPath, "log", "app.log"), []byte("first"), 0644)
+	ioutil.WriteFile(filepath.Join(firstPath, PKG_MANIFEST), manifest, 0644)
+
+	err := lr.linkShared(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := &RevisionInfo{"pkg", "1400000001Cd"}
+	secondPath := lr.revisionPath(second)
+	os.MkdirAll(filepath.Join(secondPath, "log"), 0755)
+	ioutil.WriteFile(filepath.Join(secondPath, "log", "app.log"), []byte("second"), 0644)
+	ioutil.WriteFile(filepath.Join(secondPath, PKG_MANIFEST), manifest, 0644)
+
+	err = lr.linkShared(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, revPath := range []string{firstPath, secondPath} {
+		data, err := ioutil.ReadFile(filepath.Join(revPath, "log", "app.log"))
+		if err != nil || string(data) != "first" {
+			t.Error("Expected shared log from the first revision", revPath, string(data), err)
+		}
+
+		target, err := os.Readlink(filepath.Join(revPath, "tmp", "uploads"))
+		if err != nil || target != filepath.Join(lr.BasePath, "pkg", "shared", "tmp", "uploads") {
+			t.Error("Expected uploads to be linked", revPath, target, err)
+		}
+	}
+}
+
+func Test_RenderTemplates(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	revision := &RevisionInfo{"pkg", "1400000000Ab"}
+	revPath := lr.revisionPath(revision)
+	os.MkdirAll(filepath.Join(revPath, "config"), 0755)
+	ioutil.WriteFile(filepath.Join(revPath, PKG_MANIFEST), []byte(`{"templates": ["config/app.conf.tmpl"]}`), 0644)
+	ioutil.WriteFile(filepath.Join(revPath, "config", "app.conf.tmpl"), []byte("db={{.Values.db}} rev={{.Revision}} host={{.Host.Hostname}}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(lr.BasePath, "pkg", PKG_VALUES_FILE), []byte(`{"db": "db1.example.com"}`), 0644)
+
+	err := lr.RenderTemplates(revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostname, _ := os.Hostname()
+	data, _ := ioutil.ReadFile(filepath.Join(revPath, "config", "app.conf"))
+	expected := fmt.Sprintf("db=db1.example.com rev=pkg.1400000000Ab host=%s\n", hostname)
+	if string(data) != expected {
+		t.Error("Unexpected render", string(data))
+	}
+
+	ioutil.WriteFile(filepath.Join(lr.BasePath, "pkg", PKG_VALUES_FILE), []byte(`{}`), 0644)
+	err = lr.RenderTemplates(revision)
+	if err == nil {
+		t.Error("Expected error for missing value")
+	}
+}
+
+func Test_RenderTemplates_symlink(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	revision := &RevisionInfo{"pkg", "1400000000Ab"}
+	revPath := lr.revisionPath(revision)
+	os.MkdirAll(filepath.Join(revPath, "config"), 0755)
+	ioutil.WriteFile(filepath.Join(revPath, PKG_MANIFEST), []byte(`{"templates": ["config/app.conf.tmpl"]}`), 0644)
+	ioutil.WriteFile(filepath.Join(revPath, "config", "app.conf.tmpl"), []byte("rendered\n"), 0644)
+
+	target := filepath.Join(lr.BasePath, "target")
+	ioutil.WriteFile(target, []byte("original\n"), 0644)
+
+	// An output pointing outside the revision
+	os.Symlink(target, filepath.Join(revPath, "config", "app.conf"))
+	err := lr.RenderTemplates(revision)
+	if err == nil {
+		t.Error("Expected error rendering to a symlink")
+	}
+
+	data, _ := ioutil.ReadFile(target)
+	if string(data) != "original\n" {
+		t.Error("Expected the symlink target to be untouched", string(data))
+	}
+
+	// A template pointing outside the revision
+	os.Remove(filepath.Join(revPath, "config", "app.conf"))
+	os.Remove(filepath.Join(revPath, "config", "app.conf.tmpl"))
+	os.Symlink(target, filepath.Join(revPath, "config", "app.conf.tmpl"))
+	err = lr.RenderTemplates(revision)
+	if err == nil {
+		t.Error("Expected error rendering a symlinked template")
+	}
+
+	if _, err := os.Lstat(filepath.Join(revPath, "config", "app.conf")); !os.IsNotExist(err) {
+		t.Error("Expected nothing to be rendered", err)
+	}
+}
+
+func Test_History(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+	lr.Trigger = "jump"
+
+	first := &RevisionInfo{"pkg", "1400000000Ab"}
+	second := &RevisionInfo{"pkg", "1400000001Cd"}
+	addTestScript(t, lr, first, PKG_SCRIPT_POST_JUMP, "true")
+	addTestScript(t, lr, second, PKG_SCRIPT_PRE_JUMP, "exit 0")
+
+	for _, revision := range []*RevisionInfo{first, second} {
+		err := lr.Jump(revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := lr.JumpBack("pkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := lr.History("pkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found []string
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s %s %s %s", entry.Action, entry.From, entry.To, entry.Trigger)
+		for _, hook := range entry.Hooks {
+			line += fmt.Sprintf(" [%s %s %s]", hook.Revision, hook.Hook, hook.Status)
+		}
+		found = append(found, line)
+	}
+
+	expected := []string{
+		"jump  pkg.1400000000Ab jump [pkg.1400000000Ab post-jump ok]",
+		"jump pkg.1400000000Ab pkg.1400000001Cd jump [pkg.1400000001Cd pre-jump ok]",
+		"jump-back pkg.1400000001Cd pkg.1400000000Ab jump [pkg.1400000000Ab post-jump ok]",
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Error("Unexpected history", found)
+	}
+}
+
+func Test_Rollback(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	var revisions []*RevisionInfo
+	for i := 0; i < 3; i++ {
+		revision := &RevisionInfo{"pkg", fmt.Sprintf("140000000%dAb", i)}
+		os.MkdirAll(lr.revisionPath(revision), 0755)
+		revisions = append(revisions, revision)
+
+		err := lr.Jump(revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revision, err := lr.Rollback("pkg", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *revision != *revisions[0] || *lr.GetCurrentRevision("pkg") != *revisions[0] {
+		t.Error("Expected rollback to the first revision", revision)
+	}
+
+	// The revision we rolled back from is now the most recent before current
+	recent, err := lr.RecentRevisions("pkg", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 3 || *recent[1] != *revisions[2] {
+		t.Error("Unexpected recent revisions", recent)
+	}
+
+	_, err = lr.Rollback("pkg", 3)
+	if err == nil {
+		t.Error("Expected error rolling back past the history")
+	}
+}
+
+func Test_LocalRepository_Add_archive(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	err := os.MkdirAll(filepath.Join(lr.BasePath, "pkg", "revs"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testArchive(map[string]string{"index.html": "revision data"})
+	sum, err := fileHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision := &RevisionInfo{"pkg", buildRevisionId(sum)}
+
+	// Spooled by older versions, with more than the extension after the
+	// revision
+	err = lr.Add(revision, revision.Name()+".site-1.2.tgz", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Error from Add", err)
+	}
+
+	revPath := lr.revisionPath(revision)
+	if _, err := os.Stat(filepath.Join(revPath, "index.html")); err != nil {
+		t.Error("Expected archive to be extracted", err)
+	}
+	if _, err := os.Stat(filepath.Join(revPath, revision.Name()+".site-1.2.tar")); !os.IsNotExist(err) {
+		t.Error("Expected archive to be removed", err)
+	}
+}
+
+func Test_LocalRepository_Add_refused(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	err := os.MkdirAll(filepath.Join(lr.BasePath, "pkg", "revs"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldVersion := Version
+	Version = "0.2.6"
+	defer func() { Version = oldVersion }()
+
+	data := testArchive(map[string]string{"ftl.json": `{"min_version": "9.0"}`})
+	sum, err := fileHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision := &RevisionInfo{"pkg", buildRevisionId(sum)}
+
+	err = lr.Add(revision, revision.Name()+".tgz", bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("Expected revision needing a newer ftl to be refused")
+	}
+
+	if _, err := os.Stat(lr.revisionPath(revision)); !os.IsNotExist(err) {
+		t.Error("Expected refused revision to be removed", err)
+	}
+}
+
+func Test_UnhealthyRevision(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	os.MkdirAll(filepath.Join(lr.BasePath, "pkg"), 0755)
+
+	revision, err := lr.UnhealthyRevision("pkg")
+	if err != nil || revision != nil {
+		t.Error("Expected no unhealthy revision", revision, err)
+	}
+
+	err = lr.SetUnhealthyRevision("pkg", &RevisionInfo{"pkg", "1400000001Ab"})
+	if err != nil {
+		t.Fatal("Error from SetUnhealthyRevision", err)
+	}
+
+	revision, err = lr.UnhealthyRevision("pkg")
+	if err != nil || revision == nil || revision.Name() != "pkg.1400000001Ab" {
+		t.Error("Expected unhealthy revision to be remembered", revision, err)
+	}
+
+	err = lr.SetUnhealthyRevision("pkg", nil)
+	if err != nil {
+		t.Fatal("Error from SetUnhealthyRevision", err)
+	}
+
+	revision, err = lr.UnhealthyRevision("pkg")
+	if err != nil || revision != nil {
+		t.Error("Expected unhealthy revision to be forgotten", revision, err)
+	}
+}
+
+func Test_Jump_healthCheckFailed(t *testing.T) {
+	healthCheckInterval = time.Millisecond
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	good := &RevisionInfo{"pkg", "1400000001Ab"}
+	bad := &RevisionInfo{"pkg", "1400000002Ab"}
+	os.MkdirAll(lr.revisionPath(good), 0755)
+	addTestScript(t, lr, bad, PKG_SCRIPT_HEALTHCHECK, "echo checked >> ../../checks; exit 1")
+
+	err := lr.Jump(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lr.Jump(bad)
+	healthErr, ok := err.(*HealthCheckError)
+	if !ok {
+		t.Fatal("Expected HealthCheckError", err)
+	}
+	if !healthErr.RolledBack || *healthErr.Revision != *bad {
+		t.Error("Expected to roll back from the bad revision", healthErr)
+	}
+
+	if *lr.GetCurrentRevision("pkg") != *good {
+		t.Error("Expected current to be restored", lr.GetCurrentRevision("pkg"))
+	}
+
+	checks, _ := ioutil.ReadFile(filepath.Join(lr.BasePath, "pkg", "checks"))
+	if strings.Count(string(checks), "checked") != HEALTHCHECK_ATTEMPTS {
+		t.Error("Expected every attempt to be made", string(checks))
+	}
+}
+
+func Test_CheckHealth_url(t *testing.T) {
+	healthCheckInterval = time.Millisecond
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	revision := &RevisionInfo{"pkg", "1400000001Ab"}
+	scriptDir := filepath.Join(lr.revisionPath(revision), "ftl")
+	os.MkdirAll(scriptDir, 0755)
+
+	err := ioutil.WriteFile(filepath.Join(scriptDir, PKG_HEALTHCHECK_URL), []byte(server.URL+" 200\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url, expected, err := lr.healthCheckURL(revision)
+	if err != nil || url != server.URL || expected != 200 {
+		t.Error("Unexpected health check URL", url, expected, err)
+	}
+
+	err = lr.CheckHealth(revision)
+	if err != nil {
+		t.Error("Expected revision to be healthy", err)
+	}
+
+	status = http.StatusServiceUnavailable
+	err = lr.CheckHealth(revision)
+	if err == nil || !strings.Contains(err.Error(), "returned 503, expected 200") {
+		t.Error("Expected health check to fail", err)
+	}
+}
+
+func Test_RunPackageScript_env(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+	lr.Trigger = "sync"
+
+	first := &RevisionInfo{"pkg", "1400000001Ab"}
+	second := &RevisionInfo{"pkg", "1400000002Ab"}
+	os.MkdirAll(lr.revisionPath(first), 0755)
+	addTestScript(t, lr, second, PKG_SCRIPT_POST_JUMP, "env | grep ^FTL_ > ../../env")
+
+	err := lr.Jump(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lr.Jump(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(lr.BasePath, "pkg", "env"))
+	if err != nil {
+		t.Fatal("Expected post-jump to dump its environment", err)
+	}
+
+	env := strings.Split(strings.TrimSpace(string(data)), "\n")
+	expected := []string{
+		"FTL_PACKAGE=pkg",
+		"FTL_REVISION=pkg.1400000002Ab",
+		"FTL_REVISION_PATH=" + lr.revisionPath(second),
+		"FTL_ROOT=" + lr.BasePath,
+		"FTL_HOOK=" + PKG_SCRIPT_POST_JUMP,
+		"FTL_TRIGGER=sync",
+		"FTL_CURRENT_REVISION=pkg.1400000002Ab",
+		"FTL_PREVIOUS_REVISION=pkg.1400000001Ab",
+	}
+	for _, kv := range expected {
+		found := false
+		for _, line := range env {
+			if line == kv {
+				found = true
+			}
+		}
+		if !found {
+			t.Error("Expected", kv, "in", env)
+		}
+	}
+}
+
+func Test_scriptLog(t *testing.T) {
+	revPath, err := ioutil.TempDir("", "ftl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(revPath)
+
+	log, err := newScriptLog(revPath, &RevisionInfo{"pkg", "1400000001Ab"}, PKG_SCRIPT_POST_JUMP)
+	if err != nil {
+		t.Fatal("Error from newScriptLog", err)
+	}
+
+	out := new(bytes.Buffer)
+	w := log.Writer(out)
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\nthree"))
+	w.Flush()
+	log.Close()
+
+	expected := "[pkg.1400000001Ab post-jump] one\n[pkg.1400000001Ab post-jump] two\n[pkg.1400000001Ab post-jump] three\n"
+	if out.String() != expected {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(revPath, PKG_SCRIPT_LOG))
+	if !strings.HasSuffix(string(data), " post-jump\none\ntwo\nthree\n") {
+		t.Errorf("Unexpected log %q", string(data))
+	}
+}
+
+func Test_RunPackageScript_failureTail(t *testing.T) {
+	lr := newTestLocal(t)
+	defer os.RemoveAll(lr.BasePath)
+
+	revision := &RevisionInfo{"pkg", "1400000001Ab"}
+	addTestScript(t, lr, revision, PKG_SCRIPT_PRE_JUMP, "for i in $(seq 1 15); do echo line $i; done; exit 2")
+
+	err := lr.RunPackageScript(revision, PKG_SCRIPT_PRE_JUMP)
+	pse, ok := err.(*PackageScriptError)
+	if !ok {
+		t.Fatal("Expected PackageScriptError", err)
+	}
+
+	if pse.WaitStatus.ExitStatus() != 2 {
+		t.Error("Expected exit status 2", pse.WaitStatus.ExitStatus())
+	}
+
+	if len(pse.Tail) != PKG_SCRIPT_TAIL_LINES || pse.Tail[0] != "line 6" || pse.Tail[len(pse.Tail)-1] != "line 15" {
+		t.Error("Expected the last lines of output", pse.Tail)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(lr.revisionPath(revision), PKG_SCRIPT_LOG))
+	if err != nil {
+		t.Fatal("Expected a script log", err)
+	}
+	if !strings.Contains(string(data), " pre-jump\nline 1\nline 2\n") || !strings.HasSuffix(string(data), "line 15\n") {
+		t.Errorf("Expected all output in the log %q", string(data))
+	}
+}
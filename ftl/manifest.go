@@ -0,0 +1,344 @@
+package ftl
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Optional manifest at the top of a revision, describing how to deploy it
+const PKG_MANIFEST = "ftl.json"
+
+// The running version of ftl, checked against the min_version of manifests.
+// Set by the ftl command.
+var Version string
+
+type Manifest struct {
+	// Package scripts by hook name
+	Hooks map[string]*ManifestHook `json:"hooks"`
+
+	HealthCheck *ManifestHealthCheck `json:"healthcheck"`
+
+	// Free space needed where revisions are installed, in megabytes
+	RequiredDiskMB int64 `json:"required_disk_mb"`
+
+	// Oldest version of ftl that can install the revision
+	MinVersion string `json:"min_version"`
+
+	// Who package scripts run as, by name or id. The group defaults to the
+	// user's.
+	User  string `json:"user"`
+	Group string `json:"group"`
+
+	// Paths kept in the package's shared directory, rather than each
+	// revision, so they survive jumps
+	Shared []string `json:"shared"`
+
+	// Template files rendered for this host before the revision is
+	// activated, each to the same path without its .tmpl suffix
+	Templates []string `json:"templates"`
+}
+
+// ManifestHook is the command run for a hook. Its first element is a path
+// inside the revision if it's relative and contains a '/'. Otherwise it's a
+// command on the host, found in $PATH if it has no '/'. A hook can also be
+// declared as just the path of a script inside the revision.
+type ManifestHook struct {
+	Command []string `json:"command"`
+
+	// How long the command may run, such as "90s"
+	Timeout string `json:"timeout"`
+
+	// Whether the hook was declared as a script path
+	script bool
+}
+
+func (mh *ManifestHook) UnmarshalJSON(data []byte) error {
+	var scriptPath string
+	if json.Unmarshal(data, &scriptPath) == nil {
+		mh.Command = []string{scriptPath}
+		mh.script = true
+		return nil
+	}
+
+	type manifestHook ManifestHook
+	return json.Unmarshal(data, (*manifestHook)(mh))
+}
+
+// inRevision reports whether the hook's command is a file in the revision.
+func (mh *ManifestHook) inRevision() bool {
+	return mh.script || (strings.Contains(mh.Command[0], "/") && !filepath.IsAbs(mh.Command[0]))
+}
+
+// ManifestHealthCheck is an HTTP request to check a revision is healthy,
+// taking the place of a healthcheck-url file.
+type ManifestHealthCheck struct {
+	URL string `json:"url"`
+
+	// Expected response status, 200 if not set
+	Status int `json:"status"`
+}
+
+func validHook(name string) bool {
+	for _, hook := range PKG_HOOKS {
+		if hook == name {
+			return true
+		}
+	}
+	return false
+}
+
+func insideRevision(relPath string) bool {
+	clean := filepath.Clean(relPath)
+	return relPath != "" && !filepath.IsAbs(clean) && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// parseVersion splits a version such as "0.2.6" into its numbers.
+func parseVersion(version string) (numbers []int, err error) {
+	for _, part := range strings.Split(version, ".") {
+		n, e := strconv.Atoi(part)
+		if e != nil || n < 0 {
+			err = fmt.Errorf("Invalid version %q", version)
+			return
+		}
+		numbers = append(numbers, n)
+	}
+	return
+}
+
+// olderVersion reports whether version a is older than b. Both must parse.
+func olderVersion(a, b string) bool {
+	an, _ := parseVersion(a)
+	bn, _ := parseVersion(b)
+	for i := 0; i < len(an) || i < len(bn); i++ {
+		var x, y int
+		if i < len(an) {
+			x = an[i]
+		}
+		if i < len(bn) {
+			y = bn[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+// parseManifest checks a manifest makes sense regardless of where the
+// revision ends up.
+func parseManifest(data []byte) (manifest *Manifest, err error) {
+	manifest = &Manifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		err = fmt.Errorf("Failed to parse %s: %v", PKG_MANIFEST, err)
+		return
+	}
+
+	for hook, mh := range manifest.Hooks {
+		if !validHook(hook) {
+			err = fmt.Errorf("Unknown hook %q in %s", hook, PKG_MANIFEST)
+			return
+		}
+
+		if mh == nil || len(mh.Command) == 0 || mh.Command[0] == "" {
+			err = fmt.Errorf("No command for hook %s in %s", hook, PKG_MANIFEST)
+			return
+		}
+
+		if mh.inRevision() && !insideRevision(mh.Command[0]) {
+			err = fmt.Errorf("Script for hook %s must be inside the revision: %q", hook, mh.Command[0])
+			return
+		}
+
+		if mh.Timeout != "" {
+			_, e := time.ParseDuration(mh.Timeout)
+			if e != nil {
+				err = fmt.Errorf("Invalid timeout for hook %s in %s: %v", hook, PKG_MANIFEST, e)
+				return
+			}
+		}
+	}
+
+	if hc := manifest.HealthCheck; hc != nil {
+		if hc.URL == "" {
+			err = fmt.Errorf("No url for healthcheck in %s", PKG_MANIFEST)
+			return
+		}
+		if hc.Status < 0 || hc.Status > 999 {
+			err = fmt.Errorf("Invalid healthcheck status %d in %s", hc.Status, PKG_MANIFEST)
+			return
+		}
+	}
+
+	for _, sharedPath := range manifest.Shared {
+		if !insideRevision(sharedPath) || filepath.Clean(sharedPath) == "." {
+			err = fmt.Errorf("Shared path must be inside the revision: %q", sharedPath)
+			return
+		}
+	}
+
+	for _, templatePath := range manifest.Templates {
+		if !insideRevision(templatePath) || !strings.HasSuffix(templatePath, TEMPLATE_SUFFIX) {
+			err = fmt.Errorf("Template must be a %s file inside the revision: %q", TEMPLATE_SUFFIX, templatePath)
+			return
+		}
+	}
+
+	if manifest.Group != "" && manifest.User == "" {
+		err = fmt.Errorf("group without user in %s", PKG_MANIFEST)
+		return
+	}
+
+	if manifest.RequiredDiskMB < 0 {
+		err = fmt.Errorf("Invalid required_disk_mb %d in %s", manifest.RequiredDiskMB, PKG_MANIFEST)
+		return
+	}
+
+	if manifest.MinVersion != "" {
+		_, err = parseVersion(manifest.MinVersion)
+		if err != nil {
+			err = fmt.Errorf("Invalid min_version in %s: %v", PKG_MANIFEST, err)
+			return
+		}
+	}
+	return
+}
+
+// readManifest reads the revision's manifest, or returns nil if it has none.
+func (lr *LocalRepository) readManifest(revision *RevisionInfo) (manifest *Manifest, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(lr.revisionPath(revision), PKG_MANIFEST))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	manifest, err = parseManifest(data)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", revision.Name(), err)
+	}
+	return
+}
+
+// archiveSuffix returns the extension of a tar or gzipped tar archive's file
+// name, or "" if it isn't one.
+func archiveSuffix(fileName string) string {
+	for _, suffix := range []string{"tar.gz", "tgz", "tar"} {
+		if strings.HasSuffix(fileName, "."+suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// readArchive reads the manifest and the names of the files in a tar or
+// gzipped tar archive. Files which aren't archives have neither.
+func readArchive(fileName string, r io.Reader) (manifest *Manifest, files map[string]bool, err error) {
+	switch archiveSuffix(fileName) {
+	case "tar.gz", "tgz":
+		gz, e := gzip.NewReader(r)
+		if e != nil {
+			err = fmt.Errorf("Failed to read %s: %v", fileName, e)
+			return
+		}
+		defer gz.Close()
+		r = gz
+	case "":
+		return
+	}
+
+	files = make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		header, e := tr.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			err = fmt.Errorf("Failed to read %s: %v", fileName, e)
+			return
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		name := filepath.Clean(header.Name)
+		files[name] = true
+
+		if name == PKG_MANIFEST {
+			data, e := ioutil.ReadAll(tr)
+			if e != nil {
+				err = fmt.Errorf("Failed to read %s: %v", fileName, e)
+				return
+			}
+
+			manifest, err = parseManifest(data)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// ValidateArchive checks the manifest of an archive about to be spooled, so
+// a revision which can't be installed is never uploaded.
+func ValidateArchive(fileName string, r io.Reader) error {
+	manifest, files, err := readArchive(fileName, r)
+	if err != nil || manifest == nil {
+		return err
+	}
+
+	for hook, mh := range manifest.Hooks {
+		if mh.inRevision() && !files[filepath.Clean(mh.Command[0])] {
+			return fmt.Errorf("%s declares %s for hook %s, but it isn't in the archive", PKG_MANIFEST, mh.Command[0], hook)
+		}
+	}
+
+	for _, templatePath := range manifest.Templates {
+		if !files[filepath.Clean(templatePath)] {
+			return fmt.Errorf("%s declares template %s, but it isn't in the archive", PKG_MANIFEST, templatePath)
+		}
+	}
+	return nil
+}
+
+// checkManifest makes sure this host can install a revision.
+func (lr *LocalRepository) checkManifest(revision *RevisionInfo, manifest *Manifest) error {
+	if manifest.MinVersion != "" && Version != "" && olderVersion(Version, manifest.MinVersion) {
+		return fmt.Errorf("%s requires ftl %s or newer, this is %s", revision.Name(), manifest.MinVersion, Version)
+	}
+
+	if manifest.User != "" {
+		_, err := lookupScriptUser(manifest.User, manifest.Group)
+		if err != nil {
+			return fmt.Errorf("Can't run %s scripts: %v", revision.Name(), err)
+		}
+	}
+
+	if manifest.RequiredDiskMB > 0 {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(lr.revisionPath(revision), &stat)
+		if err != nil {
+			return fmt.Errorf("Failed to check free space: %v", err)
+		}
+
+		freeMB := int64(stat.Bavail) * int64(stat.Bsize) / (1024 * 1024)
+		if freeMB < manifest.RequiredDiskMB {
+			return fmt.Errorf("%s requires %dMB free, only %dMB available", revision.Name(), manifest.RequiredDiskMB, freeMB)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package ftl
+
+import (
+	"encoding/json"
+	"fmt"
+	"launchpad.net/goamz/s3"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RevisionMeta is free form information about a revision, recorded when it
+// is spooled.
+type RevisionMeta map[string]string
+
+// Keys returns the metadata keys in sorted order, for display.
+func (meta RevisionMeta) Keys() (keys []string) {
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// gitOutput runs git in dir, or the current directory if dir is empty.
+func gitOutput(dir string, args ...string) string {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// currentUser returns the name of the user running ftl, or "" if we can't
+// tell.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// CaptureRevisionMeta collects what we can find out about who is spooling a
+// revision and from where. Git details are included when the spooled path,
+// or the current directory when spooling from stdin, is inside a repository.
+func CaptureRevisionMeta(path string) RevisionMeta {
+	meta := make(RevisionMeta)
+
+	dir := ""
+	if path != "-" && path != "" {
+		dir = path
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			dir = filepath.Dir(path)
+		}
+	}
+
+	if name := currentUser(); name != "" {
+		meta["user"] = name
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		meta["hostname"] = hostname
+	}
+
+	if commit := gitOutput(dir, "rev-parse", "HEAD"); commit != "" {
+		meta["git_commit"] = commit
+	}
+
+	if branch := gitOutput(dir, "rev-parse", "--abbrev-ref", "HEAD"); branch != "" {
+		meta["git_branch"] = branch
+	}
+
+	return meta
+}
+
+func (rr *RemoteRepository) revisionMetaFilePath(revision *RevisionInfo) string {
+	// Kept outside the "<revision name>." prefix so it's never mistaken for
+	// the revision's artifact.
+	return rr.key(fmt.Sprintf("%s-meta", revision.Name()))
+}
+
+func (rr *RemoteRepository) putRevisionMeta(revision *RevisionInfo, meta RevisionMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	err = rr.bucket.Put(rr.revisionMetaFilePath(revision), data, "application/json", s3.Private)
+	if err != nil {
+		return fmt.Errorf("Failed to put revision metadata: %v", err)
+	}
+	return nil
+}
+
+// GetRevisionMeta returns the metadata recorded for a revision. Revisions
+// spooled by older versions have none, and return nil.
+func (rr *RemoteRepository) GetRevisionMeta(revision *RevisionInfo) (meta RevisionMeta, err error) {
+	data, err := rr.getObject(rr.revisionMetaFilePath(revision))
+	if err != nil || data == nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		err = fmt.Errorf("Failed to parse metadata for %s: %v", revision.Name(), err)
+	}
+	return
+}
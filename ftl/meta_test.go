@@ -0,0 +1,115 @@
+package ftl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/goamz/s3"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingPutBucket refuses to Put keys with the given suffix.
+type failingPutBucket struct {
+	*fakeBucket
+	suffix string
+}
+
+func (b *failingPutBucket) Put(path string, data []byte, contType string, perm s3.ACL) error {
+	if strings.HasSuffix(path, b.suffix) {
+		return fmt.Errorf("refusing to put %s", path)
+	}
+	return b.fakeBucket.Put(path, data, contType, perm)
+}
+
+func Test_RemoteRepository_Spool_meta(t *testing.T) {
+	rr, _ := newTestRemote()
+	data := testArchive(map[string]string{"index.html": "revision data"})
+
+	revision, err := rr.Spool("test", "test.tgz", bytes.NewReader(data), int64(len(data)), RevisionMeta{"ticket": "OPS-1"}, false)
+	if err != nil {
+		t.Fatal("Error from Spool", err)
+	}
+
+	meta, err := rr.GetRevisionMeta(revision)
+	if err != nil {
+		t.Fatal("Error from GetRevisionMeta", err)
+	}
+
+	if meta["ticket"] != "OPS-1" {
+		t.Error("Expected ticket to be recorded", meta)
+	}
+	if meta["file_name"] != "test.tgz" {
+		t.Error("Expected file_name test.tgz", meta["file_name"])
+	}
+	if meta["size"] != fmt.Sprintf("%d", len(data)) {
+		t.Error("Expected size to be recorded", meta["size"])
+	}
+	if meta["md5"] == "" || meta["spooled_at"] == "" {
+		t.Error("Expected md5 and spooled_at to be recorded", meta)
+	}
+
+	missing, err := rr.GetRevisionMeta(&RevisionInfo{"test", "001aa"})
+	if err != nil || missing != nil {
+		t.Error("Expected no metadata for an older revision", missing, err)
+	}
+}
+
+func Test_RemoteRepository_Spool_metaFailure(t *testing.T) {
+	bucket := &failingPutBucket{newFakeBucket(), "-meta"}
+	rr := &RemoteRepository{bucket: bucket}
+	data := testArchive(map[string]string{"index.html": "revision data"})
+
+	_, err := rr.Spool("test", "test.tgz", bytes.NewReader(data), int64(len(data)), nil, false)
+	if err == nil {
+		t.Fatal("Expected error when metadata can't be written")
+	}
+
+	if len(bucket.objects) != 0 {
+		t.Error("Expected the artifact to be removed", bucket.objects)
+	}
+}
+
+func Test_CaptureRevisionMeta_git(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	repoDir, err := ioutil.TempDir("", "ftl-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "test"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoDir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal("Failed to set up repository", err, string(out))
+		}
+	}
+
+	archivePath := filepath.Join(repoDir, "test.tgz")
+	err = ioutil.WriteFile(archivePath, []byte("data"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := gitOutput(repoDir, "rev-parse", "HEAD")
+	if commit == "" {
+		t.Fatal("Expected a commit")
+	}
+
+	for _, path := range []string{archivePath, repoDir} {
+		meta := CaptureRevisionMeta(path)
+		if meta["git_commit"] != commit {
+			t.Error("Expected commit of the repository containing", path, meta)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package ftl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Log of package script output, kept in each revision directory
+const PKG_SCRIPT_LOG = ".ftl.log"
+
+// How many lines of output to include in a PackageScriptError
+const PKG_SCRIPT_TAIL_LINES = 10
+
+// Scripts from several revisions can run at once during a sync, so writes to
+// our own output are serialized a line at a time.
+var outputLock sync.Mutex
+
+// scriptLog collects the output of one package script run. Every line is
+// echoed with a prefix naming the revision and script, written to the
+// revision's log, and the last few lines kept for error messages.
+type scriptLog struct {
+	prefix string
+	log    io.WriteCloser
+	tail   []string
+	lock   sync.Mutex
+}
+
+// openScriptLog opens the revision's log for appending. Scripts may run as
+// another user, so we refuse to follow a symlink or write to a file we don't
+// own.
+func openScriptLog(logPath string) (log *os.File, err error) {
+	log, err = os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return
+	}
+
+	info, err := log.Stat()
+	if err == nil {
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !info.Mode().IsRegular() || !ok || int(stat.Uid) != os.Geteuid() {
+			err = fmt.Errorf("%s is not a regular file owned by us", logPath)
+		}
+	}
+
+	if err != nil {
+		log.Close()
+		log = nil
+	}
+	return
+}
+
+func newScriptLog(revPath string, revision *RevisionInfo, scriptName string) (sl *scriptLog, err error) {
+	log, err := openScriptLog(filepath.Join(revPath, PKG_SCRIPT_LOG))
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(log, "=== %s %s\n", time.Now().UTC().Format(time.RFC3339), scriptName)
+
+	sl = &scriptLog{prefix: fmt.Sprintf("[%s %s] ", revision.Name(), scriptName), log: log}
+	return
+}
+
+func (sl *scriptLog) writeLine(dest io.Writer, line []byte) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	sl.log.Write(line)
+	sl.log.Write([]byte("\n"))
+
+	sl.tail = append(sl.tail, string(line))
+	if len(sl.tail) > PKG_SCRIPT_TAIL_LINES {
+		sl.tail = sl.tail[1:]
+	}
+
+	outputLock.Lock()
+	fmt.Fprintf(dest, "%s%s\n", sl.prefix, line)
+	outputLock.Unlock()
+}
+
+// Writer returns a writer for one of the script's output streams, echoing
+// to dest. Call Flush on it once the script exits.
+func (sl *scriptLog) Writer(dest io.Writer) *scriptLogWriter {
+	return &scriptLogWriter{sl, dest, nil}
+}
+
+func (sl *scriptLog) Tail() []string {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	return append([]string(nil), sl.tail...)
+}
+
+func (sl *scriptLog) Close() error {
+	return sl.log.Close()
+}
+
+type scriptLogWriter struct {
+	sl   *scriptLog
+	dest io.Writer
+	buf  []byte
+}
+
+func (w *scriptLogWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.sl.writeLine(w.dest, w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes out a final line that didn't end in a newline.
+func (w *scriptLogWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.sl.writeLine(w.dest, w.buf)
+		w.buf = nil
+	}
+}
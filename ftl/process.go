@@ -0,0 +1,132 @@
+package ftl
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long package scripts may run unless configured otherwise
+const PKG_SCRIPT_TIMEOUT = 10 * time.Minute
+
+// How long a package script has to exit after SIGTERM before it's killed
+const PKG_SCRIPT_KILL_GRACE = 10 * time.Second
+
+// How long we keep reading output after a package script exits. Anything it
+// started in the background may hold its output open indefinitely.
+const PKG_SCRIPT_OUTPUT_GRACE = time.Second
+
+// Process groups of the package scripts currently running, so they can be
+// stopped along with us.
+var scriptGroups = struct {
+	sync.Mutex
+	pgids map[int]bool
+}{pgids: make(map[int]bool)}
+
+var watchSignalsOnce sync.Once
+
+// watchSignals stops any running package scripts when we're interrupted or
+// terminated, then lets the signal take its usual effect.
+func watchSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		sig := <-sigs
+
+		scriptGroups.Lock()
+		pgids := make([]int, 0, len(scriptGroups.pgids))
+		for pgid := range scriptGroups.pgids {
+			pgids = append(pgids, pgid)
+		}
+		scriptGroups.Unlock()
+
+		if len(pgids) > 0 {
+			fmt.Printf("Received %v, stopping %d package scripts\n", sig, len(pgids))
+		}
+
+		for _, pgid := range pgids {
+			syscall.Kill(-pgid, syscall.SIGTERM)
+		}
+
+		deadline := time.Now().Add(PKG_SCRIPT_KILL_GRACE)
+		for _, pgid := range pgids {
+			for time.Now().Before(deadline) && syscall.Kill(-pgid, 0) == nil {
+				time.Sleep(100 * time.Millisecond)
+			}
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		}
+
+		signal.Stop(sigs)
+		syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+	}()
+}
+
+// runScript runs cmd in its own process group. It finishes when cmd's own
+// process exits, leaving anything it started in the background running. If
+// it runs longer than timeout the whole group is sent SIGTERM, then SIGKILL if
+// it hasn't exited within PKG_SCRIPT_KILL_GRACE. A timeout of 0 means no limit.
+func runScript(cmd *exec.Cmd, timeout time.Duration) (timedOut bool, err error) {
+	watchSignalsOnce.Do(watchSignals)
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.WaitDelay = PKG_SCRIPT_OUTPUT_GRACE
+
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+
+	pgid := cmd.Process.Pid
+	scriptGroups.Lock()
+	scriptGroups.pgids[pgid] = true
+	scriptGroups.Unlock()
+
+	defer func() {
+		scriptGroups.Lock()
+		delete(scriptGroups.pgids, pgid)
+		scriptGroups.Unlock()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if err == exec.ErrWaitDelay {
+			// The script succeeded, but left something holding its output
+			err = nil
+		}
+		done <- err
+	}()
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	select {
+	case err = <-done:
+		return
+	case <-timer:
+	}
+
+	timedOut = true
+	syscall.Kill(-pgid, syscall.SIGTERM)
+
+	select {
+	case err = <-done:
+	case <-time.After(PKG_SCRIPT_KILL_GRACE):
+		syscall.Kill(-pgid, syscall.SIGKILL)
+		err = <-done
+	}
+
+	// Anything the script left running in the background goes too
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	return
+}
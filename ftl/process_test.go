@@ -0,0 +1,54 @@
+package ftl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_runScript_timeout(t *testing.T) {
+	// The background sleep holds stdout open, so we only finish if the whole
+	// process group is stopped.
+	cmd := exec.Command("sh", "-c", "sleep 30 & sleep 30")
+	cmd.Stdout = ioutil.Discard
+
+	start := time.Now()
+	timedOut, err := runScript(cmd, 100*time.Millisecond)
+	if !timedOut {
+		t.Error("Expected timeout")
+	}
+	if err == nil {
+		t.Error("Expected error")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Script group wasn't stopped promptly", time.Since(start))
+	}
+}
+
+func Test_runScript_background(t *testing.T) {
+	// The script is done once its own process exits, even though the
+	// background sleep still holds stdout open.
+	cmd := exec.Command("sh", "-c", "sleep 30 &")
+	cmd.Stdout = new(bytes.Buffer)
+
+	start := time.Now()
+	timedOut, err := runScript(cmd, 10*time.Second)
+	if timedOut || err != nil {
+		t.Error("Expected success", timedOut, err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Waited for the background process", time.Since(start))
+	}
+
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+func Test_runScript(t *testing.T) {
+	timedOut, err := runScript(exec.Command("true"), time.Second)
+	if timedOut || err != nil {
+		t.Error("Expected success", timedOut, err)
+	}
+}
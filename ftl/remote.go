@@ -1,23 +1,19 @@
 package ftl
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"launchpad.net/goamz/aws"
 	"launchpad.net/goamz/s3"
-	"os"
 	"strings"
 	"time"
 )
 
-func buildRevisionId(file *os.File) (revisionId string, err error) {
-	// Revsion id will be based on a combination of encoding timestamp and sha1 of the file.
-	hashPrefix, err := fileHashPrefix(file)
-	if err != nil {
-		return
-	}
-
+func buildRevisionId(sum []byte) (revisionId string) {
+	// Revsion id will be based on a combination of encoding timestamp and md5 of the file.
 	now := time.Now().UTC()
 	hour, min, sec := now.Clock()
 	timeStamp := fmt.Sprintf("%s%05d", now.Format("20060102"), hour*60*60+min*60+sec)
@@ -25,104 +21,333 @@ func buildRevisionId(file *os.File) (revisionId string, err error) {
 	// We're using pieces of our encoding data:
 	//  * for our timestamp, we're stripping off all but one of the heading zeros which is encoded as a dash. Also, the last = (buffer)
 	//  * For our hash, we're only using 2 bytes
-	revisionId = fmt.Sprintf("%s%s", timeStamp, hashPrefix)
+	revisionId = fmt.Sprintf("%s%s", timeStamp, hashPrefix(sum))
 	return
 }
 
+// Bucket is the part of an S3 bucket a RemoteRepository uses. It is satisfied
+// by *s3.Bucket.
+type Bucket interface {
+	Get(path string) ([]byte, error)
+	GetReader(path string) (io.ReadCloser, error)
+	Put(path string, data []byte, contType string, perm s3.ACL) error
+	PutReader(path string, r io.Reader, length int64, contType string, perm s3.ACL) error
+	Del(path string) error
+	List(prefix, delim, marker string, max int) (*s3.ListResp, error)
+}
+
 type RemoteRepository struct {
-	bucket *s3.Bucket
+	bucket  Bucket
+	prefix  string
+	channel string
+
+	// Why changes are being made, recorded in the package's history
+	Message string
 }
 
-func NewRemoteRepository(name string, auth aws.Auth, region aws.Region) (remote *RemoteRepository) {
+// NewRemoteRepository creates a repository in the named bucket. Every key ftl
+// reads or writes is placed under prefix, which allows several teams to share
+// one bucket. An empty prefix uses the whole bucket.
+func NewRemoteRepository(name, prefix string, auth aws.Auth, region aws.Region) (remote *RemoteRepository) {
 	myS3 := s3.New(auth, region)
-	bucket := myS3.Bucket(name)
-	return &RemoteRepository{bucket}
+	return NewRemoteRepositoryWithBucket(myS3.Bucket(name), prefix)
 }
 
-func (rr *RemoteRepository) ListRevisions(packageName string) (revisionList []*RevisionInfo, err error) {
-	listResp, err := rr.bucket.List(packageName+".", ".", "", 1000)
-	if err != nil {
-		fmt.Println("Failed listing", err)
-		return
+// NewRemoteRepositoryWithBucket creates a repository in an already opened
+// bucket, or anything else that behaves like one.
+func NewRemoteRepositoryWithBucket(bucket Bucket, prefix string) *RemoteRepository {
+	return &RemoteRepository{bucket: bucket, prefix: normalizePrefix(prefix)}
+}
+
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
 	}
+	return prefix + "/"
+}
 
-	for _, prefix := range listResp.CommonPrefixes {
-		revisionName := prefix[:len(prefix)-1]
-		revision := NewRevisionInfo(revisionName)
+// key maps a name within the repository to its key in the bucket.
+func (rr *RemoteRepository) key(name string) string {
+	return rr.prefix + name
+}
+
+// name maps a key in the bucket back to its name within the repository.
+func (rr *RemoteRepository) name(key string) string {
+	return strings.TrimPrefix(key, rr.prefix)
+}
+
+// Channel returns a view of the repository with its own current and previous
+// pointers. Revisions are shared between all channels of a bucket. The empty
+// name is the default channel.
+func (rr *RemoteRepository) Channel(name string) *RemoteRepository {
+	channelRepo := *rr
+	channelRepo.channel = name
+	return &channelRepo
+}
+
+// listKeys calls fn with every key under prefix, in order, fetching as many
+// pages as it takes.
+func (rr *RemoteRepository) listKeys(prefix string, fn func(key s3.Key)) error {
+	marker := ""
+	for {
+		listResp, err := rr.bucket.List(prefix, "", marker, 1000)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range listResp.Contents {
+			marker = key.Key
+			fn(key)
+		}
+
+		if !listResp.IsTruncated || len(listResp.Contents) == 0 {
+			return nil
+		}
+	}
+}
+
+// ListRevisions returns every revision of the package in the bucket, oldest
+// first. Only artifacts, which have a dot after the revision id, count.
+// Everything else under the package, such as metadata, pointers, check-ins
+// and history, is skipped.
+func (rr *RemoteRepository) ListRevisions(packageName string) (revisionList []*RevisionInfo, err error) {
+	pkgPrefix := rr.key(packageName + ".")
+	seen := make(map[string]bool)
+	err = rr.listKeys(pkgPrefix, func(key s3.Key) {
+		parts := strings.SplitN(strings.TrimPrefix(key.Key, pkgPrefix), ".", 2)
+		if len(parts) < 2 || seen[parts[0]] {
+			return
+		}
+		seen[parts[0]] = true
+
+		revision, e := NewRevisionInfo(packageName + "." + parts[0])
+		if e != nil {
+			// Not something we spooled, leave it be
+			fmt.Println("Ignoring", e)
+			return
+		}
 		revisionList = append(revisionList, revision)
+	})
+	if err != nil {
+		fmt.Println("Failed listing", err)
 	}
 
 	return
 }
 
 func (rr *RemoteRepository) ListPackages() (pkgs []string, err error) {
-	listResp, e := rr.bucket.List("", ".", "", 1000)
+	listResp, e := rr.bucket.List(rr.prefix, ".", "", 1000)
 	if e != nil {
 		err = fmt.Errorf("Failed listing: %v", e)
 		return
 	}
 
 	for _, prefix := range listResp.CommonPrefixes {
-		pkgs = append(pkgs, prefix[:len(prefix)-1])
+		pkgName := rr.name(prefix[:len(prefix)-1])
+		if ValidPackageName(pkgName) {
+			pkgs = append(pkgs, pkgName)
+		}
 	}
 	return
 }
 
-func (rr *RemoteRepository) GetRevisionReader(revision *RevisionInfo) (fileName string, reader io.ReadCloser, err error) {
-	listResp, err := rr.bucket.List(revision.Name(), "", "", 1)
+// findRevisionKey returns the key holding the revision's artifact, or nil if
+// it isn't in the bucket.
+func (rr *RemoteRepository) findRevisionKey(revision *RevisionInfo) (key *s3.Key, err error) {
+	listResp, err := rr.bucket.List(rr.key(revision.Name()+"."), "", "", 1)
 	if err != nil {
 		fmt.Println("Failed listing", err)
 		return
 	}
 
 	if len(listResp.Contents) > 0 {
-		fileName = listResp.Contents[0].Key
-		reader, err = rr.bucket.GetReader(fileName)
+		key = &listResp.Contents[0]
+	}
+
+	return
+}
+
+func (rr *RemoteRepository) GetRevisionReader(revision *RevisionInfo) (fileName string, reader io.ReadCloser, err error) {
+	key, err := rr.findRevisionKey(revision)
+	if err != nil {
+		return
+	}
+
+	if key != nil {
+		fileName = rr.name(key.Key)
+		reader, err = rr.bucket.GetReader(key.Key)
 	}
 
 	return
 }
 
-func (rr *RemoteRepository) Spool(packageName string, file *os.File) (revision *RevisionInfo, err error) {
-	statInfo, err := file.Stat()
+// VerifyRevision checks that the revision's artifact is in the bucket and, where
+// S3 reports its MD5, that it matches the hash in the revision name.
+func (rr *RemoteRepository) VerifyRevision(revision *RevisionInfo) error {
+	key, err := rr.findRevisionKey(revision)
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		return fmt.Errorf("Revision %s does not exist", revision.Name())
+	}
+
+	// The ETag is only the MD5 of the content for objects uploaded in a
+	// single PUT, which is how Spool uploads them.
+	sum, err := hex.DecodeString(strings.Trim(key.ETag, "\""))
+	if err != nil || len(sum) != md5.Size {
+		return nil
+	}
+
+	if hashPrefix(sum) != revision.Revision[len(revision.Revision)-2:] {
+		return fmt.Errorf("Checksum of %s does not match", revision.Name())
+	}
+
+	return nil
+}
+
+// FindDuplicate looks for an existing revision of the package whose content
+// has the given MD5 sum, returning the newest if there are several. It relies
+// on the ETag S3 reports, which is the MD5 of objects uploaded in a single
+// PUT.
+func (rr *RemoteRepository) FindDuplicate(packageName string, sum []byte) (revision *RevisionInfo, err error) {
+	pkgPrefix := rr.key(packageName + ".")
+	etag := fmt.Sprintf("\"%x\"", sum)
+
+	marker := ""
+	for {
+		listResp, e := rr.bucket.List(pkgPrefix, "", marker, 1000)
+		if e != nil {
+			err = fmt.Errorf("Failed listing %s: %v", packageName, e)
+			return
+		}
+
+		for _, key := range listResp.Contents {
+			marker = key.Key
+			if key.ETag != etag {
+				continue
+			}
+
+			// Only artifacts have a dot after the revision id. Metadata,
+			// pointers, check-ins and history never parse as revisions.
+			parts := strings.SplitN(strings.TrimPrefix(key.Key, pkgPrefix), ".", 2)
+			if len(parts) < 2 {
+				continue
+			}
+
+			found, e := NewRevisionInfo(packageName + "." + parts[0])
+			if e != nil {
+				continue
+			}
+
+			// Revision ids sort by the time they were spooled
+			if revision == nil || found.Revision > revision.Revision {
+				revision = found
+			}
+		}
+
+		if !listResp.IsTruncated || len(listResp.Contents) == 0 {
+			return
+		}
+	}
+}
+
+// Spool uploads the size bytes of file as a new revision of the package,
+// recording meta along with it. Everything in fileName after the first dot,
+// such as "tar.gz", is kept as the extension of the artifact so hosts know how
+// to unpack it. The name, size and MD5 of the file are added to meta.
+//
+// If an existing revision has the same content, it is returned instead unless
+// allowDuplicate is set.
+func (rr *RemoteRepository) Spool(packageName, fileName string, file io.ReadSeeker, size int64, meta RevisionMeta, allowDuplicate bool) (revision *RevisionInfo, err error) {
+	if !ValidPackageName(packageName) {
+		err = fmt.Errorf("Invalid package name %q: use only letters, digits, '_' and '-'", packageName)
+		return
+	}
+
+	// Archives keep just their archive extension, so hosts know to unpack
+	// them whatever else is in the name.
+	ext := archiveSuffix(fileName)
+	if ext == "" {
+		extNdx := strings.Index(fileName, ".")
+		if extNdx < 0 || extNdx == len(fileName)-1 {
+			err = fmt.Errorf("No extension in file name %s", fileName)
+			return
+		}
+		ext = fileName[extNdx+1:]
+	}
+
+	err = ValidateArchive(fileName, file)
+	file.Seek(0, 0)
 	if err != nil {
-		fmt.Println("Error stating file", err)
 		return
 	}
 
-	revisionId, err := buildRevisionId(file)
+	sum, err := fileHash(file)
 	if err != nil {
 		fmt.Println("Failed to build revision id")
 		return
 	}
 
-	revision = &RevisionInfo{packageName, revisionId}
+	if !allowDuplicate {
+		revision, err = rr.FindDuplicate(packageName, sum)
+		if err != nil || revision != nil {
+			if revision != nil {
+				fmt.Println("Identical to existing revision", revision.Name())
+			}
+			return
+		}
+	}
 
-	fileName := statInfo.Name()
-	nameBase := fileName[:strings.Index(fileName, ".")]
+	revision = &RevisionInfo{packageName, buildRevisionId(sum)}
 
-	s3Path := fmt.Sprintf("%s.%s.%s", nameBase, revisionId, fileName[strings.Index(fileName, ".")+1:])
-	err = rr.bucket.PutReader(s3Path, file, statInfo.Size(), "application/octet-stream", s3.Private)
+	s3Path := fmt.Sprintf("%s.%s", revision.Name(), ext)
+	err = rr.bucket.PutReader(rr.key(s3Path), file, size, "application/octet-stream", s3.Private)
 	if err != nil {
 		fmt.Println("Failed to PUT revision:", err)
 		return
 	}
+
+	if meta == nil {
+		meta = make(RevisionMeta)
+	}
+	meta["file_name"] = fileName
+	meta["size"] = fmt.Sprintf("%d", size)
+	meta["md5"] = fmt.Sprintf("%x", sum)
+	meta["spooled_at"] = time.Now().UTC().Format(time.RFC3339)
+
+	err = rr.putRevisionMeta(revision, meta)
+	if err != nil {
+		// Don't leave a revision behind without its metadata
+		rr.bucket.Del(rr.key(s3Path))
+	}
 	return
 }
 
 func (rr *RemoteRepository) currentRevisionFilePathOld(packageName string) (revisionPath string) {
-	revisionPath = fmt.Sprintf("%s.rev", packageName)
+	revisionPath = rr.key(fmt.Sprintf("%s.rev", packageName))
 	return
 }
 
-func (rr *RemoteRepository) currentRevisionFilePath(packageName string) (revisionPath string) {
-	revisionPath = fmt.Sprintf("%s.current", packageName)
+func (rr *RemoteRepository) pointerFilePath(packageName, pointer string) (revisionPath string) {
+	if rr.channel == "" {
+		revisionPath = rr.key(fmt.Sprintf("%s.%s", packageName, pointer))
+	} else {
+		// Keep the channel out of the dot separated part of the key so the
+		// pointer is never mistaken for a revision when listing.
+		revisionPath = rr.key(fmt.Sprintf("%s.%s-%s", packageName, pointer, rr.channel))
+	}
 	return
 }
 
+func (rr *RemoteRepository) currentRevisionFilePath(packageName string) (revisionPath string) {
+	return rr.pointerFilePath(packageName, "current")
+}
+
 func (rr *RemoteRepository) previousRevisionFilePath(packageName string) (revisionPath string) {
-	revisionPath = fmt.Sprintf("%s.previous", packageName)
-	return
+	return rr.pointerFilePath(packageName, "previous")
 }
 
 func (rr *RemoteRepository) revisionFromPath(revisionFilePath string) (revisionName string, err error) {
@@ -145,128 +370,164 @@ func (rr *RemoteRepository) revisionFromPath(revisionFilePath string) (revisionN
 	return
 }
 
-func (rr *RemoteRepository) GetCurrentRevision(packageName string) (revision *RevisionInfo, err error) {
+func (rr *RemoteRepository) legacyCurrentRevisionName(packageName string) (revisionName string, err error) {
 	revFile := rr.currentRevisionFilePath(packageName)
-	revisionName, err := rr.revisionFromPath(revFile)
+	revisionName, err = rr.revisionFromPath(revFile)
 	if err != nil {
 		return
 	}
 
-	if revisionName == "" {
-		oldRevFile := rr.currentRevisionFilePathOld(packageName)
-		revisionName, err = rr.revisionFromPath(oldRevFile)
-		if err != nil {
-			return
-		}
+	if revisionName == "" && rr.channel == "" {
+		// This was the old way to name this file. 'ftl migrate --master'
+		// moves it to the new layout.
+		revisionName, err = rr.revisionFromPath(rr.currentRevisionFilePathOld(packageName))
+	}
 
-		if revisionName == "" {
-			// This was the old way to name this file, let's port us to the new way:
-			err = rr.bucket.Put(revFile, []byte(revisionName), "text/plain", s3.Private)
-			if err != nil {
-				err = fmt.Errorf("Failed to put new current rev file: %v", err)
-				return
-			}
+	return
+}
 
-			rr.bucket.Del(oldRevFile)
-		}
+func (rr *RemoteRepository) GetCurrentRevision(packageName string) (revision *RevisionInfo, err error) {
+	state, err := rr.getState(packageName)
+	if err != nil {
+		return
 	}
 
-	if revisionName != "" {
-		revision = NewRevisionInfo(revisionName)
+	if state.Current != "" {
+		revision, err = NewRevisionInfo(state.Current)
 	}
 
 	return
 }
 
 func (rr *RemoteRepository) GetPreviousRevision(packageName string) (revision *RevisionInfo, err error) {
-	revFile := rr.previousRevisionFilePath(packageName)
-	revisionName, err := rr.revisionFromPath(revFile)
+	state, err := rr.getState(packageName)
 	if err != nil {
 		return
 	}
 
-	if revisionName != "" {
-		revision = NewRevisionInfo(revisionName)
+	if state.Previous != "" {
+		revision, err = NewRevisionInfo(state.Previous)
 	}
 
 	return
 }
 
-func (rr *RemoteRepository) Jump(revision *RevisionInfo) error {
+// Jump makes revision current. Unless force is set, the revision must pass
+// VerifyRevision first so hosts are never pointed at a missing artifact.
+func (rr *RemoteRepository) Jump(revision *RevisionInfo, force bool) error {
 	currentRevision, err := rr.GetCurrentRevision(revision.PackageName)
 	if err != nil {
 		return err
 	}
 
-	if currentRevision == revision {
+	if currentRevision != nil && *currentRevision == *revision {
 		fmt.Println("Revision is already selected")
 		return nil
 	}
 
-	if currentRevision != nil {
-		previousFilePath := rr.previousRevisionFilePath(revision.PackageName)
-		err = rr.bucket.Put(previousFilePath, []byte(currentRevision.Name()), "text/plain", s3.Private)
-		if err != nil {
-			return fmt.Errorf("Failed to put previous rev file: %v", err)
+	err = rr.VerifyRevision(revision)
+	if err != nil {
+		if !force {
+			return fmt.Errorf("%v (use --force to jump anyway)", err)
 		}
+		fmt.Println("Warning:", err)
 	}
 
-	currentFilePath := rr.currentRevisionFilePath(revision.PackageName)
-	err = rr.bucket.Put(currentFilePath, []byte(revision.Name()), "text/plain", s3.Private)
+	var previous string
+	err = rr.updateState(revision.PackageName, func(state *pointerState) error {
+		previous = state.Current
+		if state.Current != "" {
+			state.Previous = state.Current
+		}
+		state.Current = revision.Name()
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("Failed to put rev file: %v", err)
+		return err
 	}
 
+	rr.audit(revision.PackageName, &AuditEntry{Action: AUDIT_JUMP, Revision: revision.Name(), Previous: previous})
 	return nil
 }
 
 func (rr *RemoteRepository) JumpBack(packageName string) error {
-	previousFilePath := rr.previousRevisionFilePath(packageName)
-	currentFilePath := rr.currentRevisionFilePath(packageName)
+	entry := &AuditEntry{Action: AUDIT_JUMP_BACK}
+	err := rr.updateState(packageName, func(state *pointerState) error {
+		if state.Previous == "" {
+			return fmt.Errorf("Failed to find previous revision")
+		}
 
-	previousRevision, err := rr.revisionFromPath(previousFilePath)
+		if state.Current == "" {
+			return fmt.Errorf("Failed to find current revision")
+		}
+
+		state.Current, state.Previous = state.Previous, state.Current
+		entry.Revision, entry.Previous = state.Current, state.Previous
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	if previousRevision == "" {
-		return fmt.Errorf("Failed to find previous revision")
+	rr.audit(packageName, entry)
+	return nil
+}
+
+func (rr *RemoteRepository) Promote(revision *RevisionInfo, from, to string) error {
+	if from == to {
+		return fmt.Errorf("Can't promote from a channel to itself")
 	}
 
-	currentRevision, err := rr.revisionFromPath(currentFilePath)
+	fromRevision, err := rr.Channel(from).GetCurrentRevision(revision.PackageName)
 	if err != nil {
 		return err
 	}
 
-	if currentRevision == "" {
-		return fmt.Errorf("Failed to find current revision")
+	if fromRevision == nil || *fromRevision != *revision {
+		return fmt.Errorf("%s is not the current revision of channel %s", revision.Name(), channelDisplayName(from))
 	}
 
-	err = rr.bucket.Put(previousFilePath, []byte(currentRevision), "text/plain", s3.Private)
+	return rr.Channel(to).Jump(revision, false)
+}
+
+// PurgeRevision removes a revision from the bucket. The active revision can
+// never be purged, and the previous revision, which jump-back relies on, only
+// when force is set. Every channel's lock is held while checking and
+// removing, so no one can jump to the revision in between.
+func (rr *RemoteRepository) PurgeRevision(revision *RevisionInfo, force bool) (err error) {
+	channels, err := rr.listChannels(revision.PackageName)
 	if err != nil {
-		return fmt.Errorf("Failed to put previous rev file: %v", err)
+		return
 	}
 
-	err = rr.bucket.Put(currentFilePath, []byte(previousRevision), "text/plain", s3.Private)
-	if err != nil {
-		return fmt.Errorf("Failed to put current rev file: %v", err)
+	for _, channel := range channels {
+		unlock, e := rr.Channel(channel).lock(revision.PackageName)
+		if e != nil {
+			err = e
+			return
+		}
+		defer unlock()
 	}
 
-	return nil
-}
+	for _, channel := range channels {
+		state, e := rr.Channel(channel).getState(revision.PackageName)
+		if e != nil {
+			err = e
+			return
+		}
 
-func (rr *RemoteRepository) PurgeRevision(revision *RevisionInfo) (err error) {
-	activeRevision, err := rr.GetCurrentRevision(revision.PackageName)
-	if err != nil {
-		return
-	}
+		if state.Current == revision.Name() {
+			err = fmt.Errorf("Can't purge active revision of channel %s", channelDisplayName(channel))
+			return
+		}
 
-	if activeRevision == revision {
-		err = errors.New("Can't purge active revision")
-		return
+		if state.Previous == revision.Name() && !force {
+			err = fmt.Errorf("Can't purge previous revision of channel %s without --force", channelDisplayName(channel))
+			return
+		}
 	}
 
-	listResp, err := rr.bucket.List(revision.Name()+".", "/", "", 1)
+	listResp, err := rr.bucket.List(rr.key(revision.Name()+"."), "/", "", 1)
 	if err != nil {
 		fmt.Println("Failed listing", err)
 		err = fmt.Errorf("Failed listing %v", err)
@@ -278,7 +539,21 @@ func (rr *RemoteRepository) PurgeRevision(revision *RevisionInfo) (err error) {
 		if err != nil {
 			fmt.Printf("Failed to remove", err)
 			err = fmt.Errorf("Failed to do s3 Del: %v", err)
+			return
 		}
+
+		err = rr.bucket.Del(rr.revisionMetaFilePath(revision))
+		if err != nil {
+			err = fmt.Errorf("Failed to remove metadata: %v", err)
+			return
+		}
+
+		err = rr.untagRevision(revision)
+		if err != nil {
+			return
+		}
+
+		rr.audit(revision.PackageName, &AuditEntry{Action: AUDIT_PURGE, Revision: revision.Name()})
 	} else {
 		err = errors.New("Failed to find revision")
 	}
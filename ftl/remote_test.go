@@ -0,0 +1,864 @@
+package ftl
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goamz/s3"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBucket is an in memory Bucket implementing enough of S3's listing
+// semantics for RemoteRepository.
+type fakeBucket struct {
+	objects map[string][]byte
+	etags   map[string]string
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{make(map[string][]byte), make(map[string]string)}
+}
+
+func (b *fakeBucket) Get(path string) ([]byte, error) {
+	data, ok := b.objects[path]
+	if !ok {
+		return nil, &s3.Error{StatusCode: 404, Code: "NoSuchKey"}
+	}
+	return data, nil
+}
+
+func (b *fakeBucket) GetReader(path string) (io.ReadCloser, error) {
+	data, err := b.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *fakeBucket) Put(path string, data []byte, contType string, perm s3.ACL) error {
+	b.objects[path] = data
+	return nil
+}
+
+func (b *fakeBucket) PutReader(path string, r io.Reader, length int64, contType string, perm s3.ACL) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.objects[path] = data
+	b.etags[path] = fmt.Sprintf("\"%x\"", md5.Sum(data))
+	return nil
+}
+
+func (b *fakeBucket) Del(path string) error {
+	delete(b.objects, path)
+	delete(b.etags, path)
+	return nil
+}
+
+func (b *fakeBucket) List(prefix, delim, marker string, max int) (*s3.ListResp, error) {
+	keys := make([]string, 0, len(b.objects))
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	resp := &s3.ListResp{Prefix: prefix, Delimiter: delim, Marker: marker, MaxKeys: max}
+	seenPrefixes := make(map[string]bool)
+	for _, key := range keys {
+		if len(resp.Contents)+len(resp.CommonPrefixes) >= max {
+			resp.IsTruncated = true
+			break
+		}
+
+		if delim != "" {
+			if i := strings.Index(key[len(prefix):], delim); i >= 0 {
+				commonPrefix := key[:len(prefix)+i+len(delim)]
+				if !seenPrefixes[commonPrefix] {
+					seenPrefixes[commonPrefix] = true
+					resp.CommonPrefixes = append(resp.CommonPrefixes, commonPrefix)
+				}
+				continue
+			}
+		}
+
+		resp.Contents = append(resp.Contents, s3.Key{Key: key, Size: int64(len(b.objects[key])), ETag: b.etags[key]})
+	}
+	return resp, nil
+}
+
+func newTestRemote(objects ...string) (*RemoteRepository, *fakeBucket) {
+	bucket := newFakeBucket()
+	for _, key := range objects {
+		bucket.objects[key] = []byte("data")
+	}
+	return &RemoteRepository{bucket: bucket}, bucket
+}
+
+func Test_RemoteRepository_Jump(t *testing.T) {
+	rr, _ := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+
+	err := rr.Jump(&RevisionInfo{"test", "001aa"}, false)
+	if err != nil {
+		t.Fatal("Error from Jump", err)
+	}
+
+	err = rr.Jump(&RevisionInfo{"test", "002bb"}, false)
+	if err != nil {
+		t.Fatal("Error from Jump", err)
+	}
+
+	state, err := rr.getState("test")
+	if err != nil {
+		t.Fatal("Error from getState", err)
+	}
+
+	if state.Current != "test.002bb" {
+		t.Error("Expected current test.002bb", state.Current)
+	}
+	if state.Previous != "test.001aa" {
+		t.Error("Expected previous test.001aa", state.Previous)
+	}
+}
+
+func Test_RemoteRepository_Jump_alreadySelected(t *testing.T) {
+	rr, bucket := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+	rr.Jump(&RevisionInfo{"test", "001aa"}, false)
+	rr.Jump(&RevisionInfo{"test", "002bb"}, false)
+
+	// Only survives if the state isn't written again
+	bucket.objects["test.state"] = []byte(`{"current": "test.002bb", "previous": "test.001aa", "untouched": true}`)
+
+	err := rr.Jump(&RevisionInfo{"test", "002bb"}, false)
+	if err != nil {
+		t.Fatal("Error from Jump", err)
+	}
+
+	state, _ := rr.getState("test")
+	if state.Previous != "test.001aa" {
+		t.Error("Expected previous to be untouched", state.Previous)
+	}
+	if !strings.Contains(string(bucket.objects["test.state"]), "untouched") {
+		t.Error("Expected state not to be rewritten", string(bucket.objects["test.state"]))
+	}
+}
+
+func Test_RemoteRepository_Jump_legacyPointers(t *testing.T) {
+	rr, bucket := newTestRemote("test.001aa.tgz", "test.002bb.tgz", "test.003cc.tgz")
+	bucket.objects["test.current"] = []byte("test.002bb")
+	bucket.objects["test.previous"] = []byte("test.001aa")
+
+	err := rr.Jump(&RevisionInfo{"test", "003cc"}, false)
+	if err != nil {
+		t.Fatal("Error from Jump", err)
+	}
+
+	// Hosts that haven't been upgraded still follow the jump
+	if string(bucket.objects["test.current"]) != "test.003cc" || string(bucket.objects["test.previous"]) != "test.002bb" {
+		t.Error("Expected old pointer files to follow the jump", string(bucket.objects["test.current"]), string(bucket.objects["test.previous"]))
+	}
+
+	// A package without them doesn't grow them
+	rr.Channel("staging").Jump(&RevisionInfo{"test", "003cc"}, false)
+	if _, ok := bucket.objects["test.current-staging"]; ok {
+		t.Error("Expected no old pointer files for a new channel")
+	}
+}
+
+func Test_RemoteRepository_Channel(t *testing.T) {
+	rr, bucket := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+
+	err := rr.Jump(&RevisionInfo{"test", "001aa"}, false)
+	if err != nil {
+		t.Fatal("Error from Jump", err)
+	}
+
+	staging := rr.Channel("staging")
+	err = staging.Jump(&RevisionInfo{"test", "002bb"}, false)
+	if err != nil {
+		t.Fatal("Error from Jump", err)
+	}
+
+	current, err := rr.GetCurrentRevision("test")
+	if err != nil || current == nil || current.Revision != "001aa" {
+		t.Error("Expected default channel to be unchanged", current, err)
+	}
+
+	current, err = staging.GetCurrentRevision("test")
+	if err != nil || current == nil || current.Revision != "002bb" {
+		t.Error("Expected staging to have its own current", current, err)
+	}
+
+	previous, err := staging.GetPreviousRevision("test")
+	if err != nil || previous != nil {
+		t.Error("Expected staging to have no previous", previous, err)
+	}
+
+	if _, ok := bucket.objects["test.state-staging"]; !ok {
+		t.Error("Expected staging state under its own key")
+	}
+
+	// Revisions are shared
+	revisions, err := staging.ListRevisions("test")
+	if err != nil || len(revisions) != 2 {
+		t.Error("Expected channels to share revisions", revisions, err)
+	}
+}
+
+func Test_RemoteRepository_Promote(t *testing.T) {
+	rr, _ := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+	rr.Jump(&RevisionInfo{"test", "001aa"}, false)
+	rr.Channel("staging").Jump(&RevisionInfo{"test", "002bb"}, false)
+
+	err := rr.Promote(&RevisionInfo{"test", "001aa"}, "staging", "")
+	if err == nil {
+		t.Error("Expected error promoting a revision that isn't current in staging")
+	}
+
+	err = rr.Promote(&RevisionInfo{"test", "002bb"}, "staging", "staging")
+	if err == nil {
+		t.Error("Expected error promoting to the same channel")
+	}
+
+	current, _ := rr.GetCurrentRevision("test")
+	if current == nil || current.Revision != "001aa" {
+		t.Error("Expected failed promotes to leave the default channel alone", current)
+	}
+
+	err = rr.Promote(&RevisionInfo{"test", "002bb"}, "staging", "")
+	if err != nil {
+		t.Fatal("Error from Promote", err)
+	}
+
+	current, _ = rr.GetCurrentRevision("test")
+	previous, _ := rr.GetPreviousRevision("test")
+	if current == nil || current.Revision != "002bb" || previous == nil || previous.Revision != "001aa" {
+		t.Error("Expected promote to jump the default channel", current, previous)
+	}
+
+	current, _ = rr.Channel("staging").GetCurrentRevision("test")
+	if current == nil || current.Revision != "002bb" {
+		t.Error("Expected staging to be unchanged", current)
+	}
+}
+
+func Test_RemoteRepository_lock(t *testing.T) {
+	rr, bucket := newTestRemote()
+
+	unlock, err := rr.lock("test")
+	if err != nil {
+		t.Fatal("Error from lock", err)
+	}
+
+	_, err = rr.lock("test")
+	if _, ok := err.(*LockError); !ok {
+		t.Error("Expected LockError while the lock is held", err)
+	}
+
+	// Another channel has its own lock
+	otherUnlock, err := rr.Channel("staging").lock("test")
+	if err != nil {
+		t.Error("Error from lock in another channel", err)
+	} else {
+		otherUnlock()
+	}
+
+	unlock()
+	if _, ok := bucket.objects["test.lock"]; ok {
+		t.Error("Expected unlock to remove the lock")
+	}
+
+	unlock, err = rr.lock("test")
+	if err != nil {
+		t.Fatal("Error from lock after unlock", err)
+	}
+	unlock()
+}
+
+func Test_RemoteRepository_lock_expired(t *testing.T) {
+	rr, _ := newTestRemote()
+
+	acquired := time.Now().UTC().Add(-2 * REMOTE_LOCK_TIMEOUT)
+	stale := &remoteLock{"crashed:1:00", acquired}
+	data, _ := json.Marshal(stale)
+	rr.bucket.Put("test.lock", data, "application/json", s3.Private)
+
+	unlock, err := rr.lock("test")
+	if err != nil {
+		t.Fatal("Expected expired lock to be taken over", err)
+	}
+	defer unlock()
+
+	lock, _ := rr.getLock("test")
+	if lock == nil || lock.Owner == stale.Owner {
+		t.Error("Expected our lock to replace the expired one", lock)
+	}
+}
+
+func Test_RemoteRepository_unlock_otherOwner(t *testing.T) {
+	rr, bucket := newTestRemote()
+
+	unlock, err := rr.lock("test")
+	if err != nil {
+		t.Fatal("Error from lock", err)
+	}
+
+	// Someone took the lock over from us, say after it expired
+	other := &remoteLock{"other:2:00", time.Now().UTC()}
+	data, _ := json.Marshal(other)
+	bucket.objects["test.lock"] = data
+
+	unlock()
+
+	lock, _ := rr.getLock("test")
+	if lock == nil || lock.Owner != other.Owner {
+		t.Error("Expected unlock to leave the other owner's lock", lock)
+	}
+}
+
+func Test_RemoteRepository_Jump_missing(t *testing.T) {
+	rr, _ := newTestRemote("test.001aa.tgz")
+
+	err := rr.Jump(&RevisionInfo{"test", "002bb"}, false)
+	if err == nil {
+		t.Error("Expected error jumping to missing revision")
+	}
+
+	current, _ := rr.GetCurrentRevision("test")
+	if current != nil {
+		t.Error("Expected no current revision", current)
+	}
+
+	err = rr.Jump(&RevisionInfo{"test", "002bb"}, true)
+	if err != nil {
+		t.Error("Error from forced Jump", err)
+	}
+
+	current, _ = rr.GetCurrentRevision("test")
+	if current == nil || current.Revision != "002bb" {
+		t.Error("Expected current 002bb", current)
+	}
+}
+
+func Test_RemoteRepository_VerifyRevision_checksum(t *testing.T) {
+	rr, bucket := newTestRemote()
+	data := []byte("revision data")
+	sum := md5.Sum(data)
+	hashPrefix := encodeBytes(sum[:])[:2]
+
+	bucket.PutReader("test.001"+hashPrefix+".tgz", bytes.NewReader(data), int64(len(data)), "", s3.Private)
+	err := rr.VerifyRevision(&RevisionInfo{"test", "001" + hashPrefix})
+	if err != nil {
+		t.Error("Error from VerifyRevision", err)
+	}
+
+	bucket.PutReader("test.002xx.tgz", bytes.NewReader(data), int64(len(data)), "", s3.Private)
+	err = rr.VerifyRevision(&RevisionInfo{"test", "002xx"})
+	if err == nil {
+		t.Error("Expected checksum error")
+	}
+}
+
+func Test_RemoteRepository_PurgeRevision(t *testing.T) {
+	rr, bucket := newTestRemote("test.001aa.tgz", "test.002bb.tgz", "test.003cc.tgz")
+	rr.Jump(&RevisionInfo{"test", "002bb"}, false)
+	rr.Jump(&RevisionInfo{"test", "003cc"}, false)
+
+	err := rr.PurgeRevision(&RevisionInfo{"test", "001aa"}, false)
+	if err != nil {
+		t.Error("Error from PurgeRevision", err)
+	}
+
+	if _, ok := bucket.objects["test.001aa.tgz"]; ok {
+		t.Error("Expected revision to be removed")
+	}
+}
+
+func Test_RemoteRepository_PurgeRevision_active(t *testing.T) {
+	rr, bucket := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+	rr.Jump(&RevisionInfo{"test", "001aa"}, false)
+	rr.Jump(&RevisionInfo{"test", "002bb"}, false)
+
+	err := rr.PurgeRevision(&RevisionInfo{"test", "002bb"}, true)
+	if err == nil {
+		t.Error("Expected error purging active revision")
+	}
+
+	if _, ok := bucket.objects["test.002bb.tgz"]; !ok {
+		t.Error("Expected active revision to remain")
+	}
+}
+
+func Test_RemoteRepository_PurgeRevision_activeChannel(t *testing.T) {
+	rr, bucket := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+	rr.Channel("staging").Jump(&RevisionInfo{"test", "002bb"}, false)
+
+	err := rr.PurgeRevision(&RevisionInfo{"test", "002bb"}, true)
+	if err == nil {
+		t.Error("Expected error purging revision active in another channel")
+	}
+
+	if _, ok := bucket.objects["test.002bb.tgz"]; !ok {
+		t.Error("Expected active revision to remain")
+	}
+}
+
+func Test_RemoteRepository_PurgeRevision_locked(t *testing.T) {
+	rr, bucket := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+	rr.Channel("staging").Jump(&RevisionInfo{"test", "002bb"}, false)
+
+	// Someone is in the middle of a jump in staging
+	unlock, err := rr.Channel("staging").lock("test")
+	if err != nil {
+		t.Fatal("Error from lock", err)
+	}
+
+	err = rr.PurgeRevision(&RevisionInfo{"test", "001aa"}, false)
+	if _, ok := err.(*LockError); !ok {
+		t.Error("Expected LockError purging while a channel is locked", err)
+	}
+	if _, ok := bucket.objects["test.001aa.tgz"]; !ok {
+		t.Error("Expected revision to remain")
+	}
+
+	unlock()
+
+	err = rr.PurgeRevision(&RevisionInfo{"test", "001aa"}, false)
+	if err != nil {
+		t.Error("Error from PurgeRevision", err)
+	}
+	if _, ok := bucket.objects["test.lock-staging"]; ok {
+		t.Error("Expected purge to release the locks")
+	}
+}
+
+func Test_RemoteRepository_PurgeRevision_legacyChannel(t *testing.T) {
+	rr, bucket := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+	bucket.objects["test.current-staging"] = []byte("test.002bb")
+
+	err := rr.PurgeRevision(&RevisionInfo{"test", "002bb"}, true)
+	if err == nil {
+		t.Error("Expected error purging revision active in another channel's old pointers")
+	}
+
+	if _, ok := bucket.objects["test.002bb.tgz"]; !ok {
+		t.Error("Expected active revision to remain")
+	}
+}
+
+func Test_RemoteRepository_PurgeRevision_previous(t *testing.T) {
+	rr, bucket := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+	rr.Jump(&RevisionInfo{"test", "001aa"}, false)
+	rr.Jump(&RevisionInfo{"test", "002bb"}, false)
+
+	err := rr.PurgeRevision(&RevisionInfo{"test", "001aa"}, false)
+	if err == nil {
+		t.Error("Expected error purging previous revision")
+	}
+
+	if _, ok := bucket.objects["test.001aa.tgz"]; !ok {
+		t.Error("Expected previous revision to remain")
+	}
+
+	err = rr.PurgeRevision(&RevisionInfo{"test", "001aa"}, true)
+	if err != nil {
+		t.Error("Error from forced PurgeRevision", err)
+	}
+
+	if _, ok := bucket.objects["test.001aa.tgz"]; ok {
+		t.Error("Expected previous revision to be removed")
+	}
+}
+
+func Test_RemoteRepository_Migrate(t *testing.T) {
+	rr, bucket := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+	bucket.objects["test.rev"] = []byte("test.002bb")
+	bucket.objects["test.previous"] = []byte("test.001aa")
+
+	current, err := rr.GetCurrentRevision("test")
+	if err != nil {
+		t.Fatal("Error from GetCurrentRevision", err)
+	}
+	if current == nil || current.Revision != "002bb" {
+		t.Error("Expected current 002bb from old layout", current)
+	}
+	if len(bucket.objects) != 4 {
+		t.Error("Expected reading to leave the bucket alone", bucket.objects)
+	}
+
+	err = rr.Migrate("test", true)
+	if err != nil {
+		t.Fatal("Error from dry run Migrate", err)
+	}
+	if len(bucket.objects) != 4 {
+		t.Error("Expected dry run to leave the bucket alone", bucket.objects)
+	}
+
+	err = rr.Migrate("test", false)
+	if err != nil {
+		t.Fatal("Error from Migrate", err)
+	}
+
+	if _, ok := bucket.objects["test.rev"]; ok {
+		t.Error("Expected test.rev to be removed")
+	}
+	if _, ok := bucket.objects["test.previous"]; ok {
+		t.Error("Expected test.previous to be removed")
+	}
+
+	state, _ := rr.getState("test")
+	if state.Current != "test.002bb" || state.Previous != "test.001aa" {
+		t.Error("Expected migrated state", state)
+	}
+}
+
+func Test_RemoteRepository_Migrate_paged(t *testing.T) {
+	rr, bucket := newTestRemoteMany(600)
+	bucket.objects["test.current-staging"] = []byte("test.00599aa")
+	bucket.objects["test.previous-staging"] = []byte("test.00598aa")
+
+	err := rr.Migrate("test", false)
+	if err != nil {
+		t.Fatal("Error from Migrate", err)
+	}
+
+	if _, ok := bucket.objects["test.current-staging"]; ok {
+		t.Error("Expected test.current-staging to be removed")
+	}
+
+	state, _ := rr.Channel("staging").getState("test")
+	if state.Current != "test.00599aa" || state.Previous != "test.00598aa" {
+		t.Error("Expected migrated state", state)
+	}
+}
+
+func Test_RemoteRepository_ResolveRevision(t *testing.T) {
+	rr, _ := newTestRemote("test.001aa.tgz", "test.002bb.tgz", "test.003cc.tgz")
+
+	err := rr.Tag(&RevisionInfo{"test", "002bb"}, "v1.0")
+	if err != nil {
+		t.Fatal("Error from Tag", err)
+	}
+
+	revision, err := rr.ResolveRevision("test@v1.0")
+	if err != nil || revision.Revision != "002bb" {
+		t.Error("Expected tag to resolve to 002bb", revision, err)
+	}
+
+	revision, err = rr.ResolveRevision("test@latest")
+	if err != nil || revision.Revision != "003cc" {
+		t.Error("Expected latest to resolve to 003cc", revision, err)
+	}
+
+	revision, err = rr.ResolveRevision("test.001aa")
+	if err != nil || revision.Revision != "001aa" {
+		t.Error("Expected plain name to resolve to 001aa", revision, err)
+	}
+
+	_, err = rr.ResolveRevision("test@v2.0")
+	if err == nil {
+		t.Error("Expected error for unknown tag")
+	}
+
+	err = rr.Tag(&RevisionInfo{"test", "004dd"}, "v2.0")
+	if err == nil {
+		t.Error("Expected error tagging missing revision")
+	}
+}
+
+func Test_RemoteRepository_Spool_extension(t *testing.T) {
+	rr, bucket := newTestRemote()
+	data := testArchive(map[string]string{"index.html": "revision data"})
+
+	revision, err := rr.Spool("my_site", "my.site-1.2.tgz", bytes.NewReader(data), int64(len(data)), nil, false)
+	if err != nil {
+		t.Fatal("Error from Spool", err)
+	}
+
+	if _, ok := bucket.objects[revision.Name()+".tgz"]; !ok {
+		t.Error("Expected archive extension only", bucket.objects)
+	}
+}
+
+// newTestRemoteMany returns a repository holding n revisions of "test", each
+// with its metadata, more than fit in one page of a listing.
+func newTestRemoteMany(n int) (*RemoteRepository, *fakeBucket) {
+	rr, bucket := newTestRemote()
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("test.%05daa", i)
+		bucket.objects[name+".tgz"] = []byte("data")
+		bucket.objects[name+"-meta"] = []byte("{}")
+	}
+	return rr, bucket
+}
+
+func Test_RemoteRepository_ListRevisions_paged(t *testing.T) {
+	rr, _ := newTestRemoteMany(600)
+
+	revisions, err := rr.ListRevisions("test")
+	if err != nil {
+		t.Fatal("Error from ListRevisions", err)
+	}
+
+	if len(revisions) != 600 {
+		t.Fatal("Expected 600 revisions", len(revisions))
+	}
+	if revisions[0].Name() != "test.00000aa" || revisions[599].Name() != "test.00599aa" {
+		t.Error("Expected revisions oldest first", revisions[0], revisions[599])
+	}
+}
+
+func Test_RemoteRepository_ResolveRevision_latestPaged(t *testing.T) {
+	rr, _ := newTestRemoteMany(600)
+
+	revision, err := rr.ResolveRevision("test@latest")
+	if err != nil || revision.Name() != "test.00599aa" {
+		t.Error("Expected latest to resolve to the newest revision", revision, err)
+	}
+}
+
+func Test_RemoteRepository_FindDuplicate(t *testing.T) {
+	rr, bucket := newTestRemote()
+	sum := md5.Sum([]byte("revision data"))
+	etag := fmt.Sprintf("\"%x\"", sum)
+
+	// Enough keys between the revisions that the newest is on a later page
+	for i := 0; i < 1200; i++ {
+		bucket.objects[fmt.Sprintf("test.001zz%04d-meta", i)] = []byte("{}")
+	}
+	for _, key := range []string{"test.001aa.tgz", "test.002bb.tgz", "test.003cc-meta"} {
+		bucket.objects[key] = []byte("revision data")
+		bucket.etags[key] = etag
+	}
+
+	revision, err := rr.FindDuplicate("test", sum[:])
+	if err != nil {
+		t.Fatal("Error from FindDuplicate", err)
+	}
+
+	if revision == nil || revision.Name() != "test.002bb" {
+		t.Error("Expected newest matching revision test.002bb", revision)
+	}
+}
+
+func Test_RemoteRepository_Spool_duplicate(t *testing.T) {
+	rr, bucket := newTestRemote()
+	data := testArchive(map[string]string{"index.html": "revision data"})
+
+	first, err := rr.Spool("test", "test.tgz", bytes.NewReader(data), int64(len(data)), nil, false)
+	if err != nil {
+		t.Fatal("Error from Spool", err)
+	}
+
+	objectCount := len(bucket.objects)
+
+	second, err := rr.Spool("test", "test.tgz", bytes.NewReader(data), int64(len(data)), nil, false)
+	if err != nil {
+		t.Fatal("Error from Spool", err)
+	}
+
+	if *first != *second {
+		t.Error("Expected the existing revision", first, second)
+	}
+
+	if len(bucket.objects) != objectCount {
+		t.Error("Expected nothing new to be uploaded", bucket.objects)
+	}
+
+	other := testArchive(map[string]string{"index.html": "other data"})
+	third, err := rr.Spool("test", "test.tgz", bytes.NewReader(other), int64(len(other)), nil, false)
+	if err != nil {
+		t.Fatal("Error from Spool", err)
+	}
+
+	if *third == *first {
+		t.Error("Expected a new revision for different content", third)
+	}
+
+	broken := testArchive(map[string]string{"ftl.json": `{"hooks": {"post-deploy": "deploy.sh"}}`})
+	_, err = rr.Spool("test", "test.tgz", bytes.NewReader(broken), int64(len(broken)), nil, false)
+	if err == nil {
+		t.Error("Expected invalid manifest to be rejected")
+	}
+}
+
+func Test_RemoteRepository_prefix(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["other.001aa.tgz"] = []byte("data")
+	bucket.objects["elsewhere/test.001aa.tgz"] = []byte("data")
+	rr := NewRemoteRepositoryWithBucket(bucket, "/team/")
+
+	archive := testArchive(map[string]string{"data": "v1"})
+	revision, err := rr.Spool("test", "test.tgz", bytes.NewReader(archive), int64(len(archive)), nil, false)
+	if err != nil {
+		t.Fatal("Error from Spool", err)
+	}
+
+	revisions, err := rr.ListRevisions("test")
+	if err != nil || len(revisions) != 1 || *revisions[0] != *revision {
+		t.Error("Expected only the spooled revision", revisions, err)
+	}
+
+	err = rr.Jump(revision, false)
+	if err != nil {
+		t.Fatal("Error from Jump", err)
+	}
+
+	err = rr.Tag(revision, "v1")
+	if err != nil {
+		t.Fatal("Error from Tag", err)
+	}
+
+	tagged, err := rr.ResolveRevision("test@v1")
+	if err != nil || *tagged != *revision {
+		t.Error("Expected tag to resolve", tagged, err)
+	}
+
+	entries, err := rr.AuditHistory("test")
+	if err != nil || len(entries) != 2 {
+		t.Error("Expected history of the jump and tag", entries, err)
+	}
+
+	err = rr.CheckIn("test", "web1", revision, nil)
+	if err != nil {
+		t.Fatal("Error from CheckIn", err)
+	}
+
+	for key := range bucket.objects {
+		if key == "other.001aa.tgz" || key == "elsewhere/test.001aa.tgz" {
+			continue
+		}
+		if !strings.HasPrefix(key, "team/") {
+			t.Error("Expected key under the prefix", key)
+		}
+	}
+	for _, key := range []string{"team/test.state", "team/test.tags", "team/test.checkin/web1"} {
+		if _, ok := bucket.objects[key]; !ok {
+			t.Error("Expected", key)
+		}
+	}
+
+	pkgs, err := rr.ListPackages()
+	if err != nil || len(pkgs) != 1 || pkgs[0] != "test" {
+		t.Error("Expected only packages under the prefix", pkgs, err)
+	}
+}
+
+func Test_RemoteRepository_AuditHistory(t *testing.T) {
+	rr, _ := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+	rr.Message = "fixing the widget"
+
+	for _, revision := range []*RevisionInfo{{"test", "001aa"}, {"test", "002bb"}} {
+		err := rr.Jump(revision, false)
+		if err != nil {
+			t.Fatal("Error from Jump", err)
+		}
+	}
+
+	err := rr.Tag(&RevisionInfo{"test", "002bb"}, "v2")
+	if err != nil {
+		t.Fatal("Error from Tag", err)
+	}
+
+	// Nothing to jump back to, so nothing is recorded
+	err = rr.Channel("canary").JumpBack("test")
+	if err == nil {
+		t.Error("Expected error jumping back a channel with no previous revision")
+	}
+
+	err = rr.JumpBack("test")
+	if err != nil {
+		t.Fatal("Error from JumpBack", err)
+	}
+
+	entries, err := rr.AuditHistory("test")
+	if err != nil {
+		t.Fatal("Error from AuditHistory", err)
+	}
+
+	var found []string
+	for _, entry := range entries {
+		found = append(found, fmt.Sprintf("%s %s %s %s %s", entry.Action, entry.Revision, entry.Previous, entry.Tag, entry.Message))
+	}
+
+	expected := []string{
+		"jump test.001aa   fixing the widget",
+		"jump test.002bb test.001aa  fixing the widget",
+		"tag test.002bb  v2 fixing the widget",
+		"jump-back test.001aa test.002bb  fixing the widget",
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Error("Unexpected history", found)
+	}
+
+	revisions, err := rr.ListRevisions("test")
+	if err != nil || len(revisions) != 2 {
+		t.Error("Expected history not to be listed as revisions", revisions, err)
+	}
+}
+
+func Test_RemoteRepository_ListCheckIns(t *testing.T) {
+	rr, bucket := newTestRemote("test.001aa.tgz", "test.002bb.tgz")
+
+	err := rr.CheckIn("test", "web1.example.com", &RevisionInfo{"test", "001aa"}, nil)
+	if err != nil {
+		t.Fatal("Error from CheckIn", err)
+	}
+
+	// A channel that happens to be called default is still its own channel
+	err = rr.Channel("default").CheckIn("test", "web2.example.com", &RevisionInfo{"test", "002bb"}, &RevisionInfo{"test", "001aa"})
+	if err != nil {
+		t.Fatal("Error from CheckIn", err)
+	}
+
+	// Left by an older version
+	bucket.objects["test.checkin/canary/web3"] = []byte(`{"host": "web3", "revision": "test.001aa"}`)
+
+	checkIns, err := rr.ListCheckIns("test")
+	if err != nil {
+		t.Fatal("Error from ListCheckIns", err)
+	}
+	if len(checkIns) != 1 || checkIns[0].Host != "web1.example.com" || checkIns[0].Revision != "test.001aa" {
+		t.Error("Unexpected default check-ins", checkIns)
+	}
+
+	checkIns, err = rr.Channel("default").ListCheckIns("test")
+	if err != nil {
+		t.Fatal("Error from ListCheckIns", err)
+	}
+	if len(checkIns) != 1 || checkIns[0].Host != "web2.example.com" || checkIns[0].Failed != "test.001aa" {
+		t.Error("Unexpected channel check-ins", checkIns)
+	}
+
+	revisions, err := rr.ListRevisions("test")
+	if err != nil || len(revisions) != 2 {
+		t.Error("Expected check-ins not to be listed as revisions", revisions, err)
+	}
+}
+
+func Test_RemoteRepository_ListCheckIns_paged(t *testing.T) {
+	rr, _ := newTestRemote("test.001aa.tgz")
+
+	for i := 0; i < 1005; i++ {
+		err := rr.CheckIn("test", fmt.Sprintf("web%d", i), &RevisionInfo{"test", "001aa"}, nil)
+		if err != nil {
+			t.Fatal("Error from CheckIn", err)
+		}
+	}
+
+	checkIns, err := rr.ListCheckIns("test")
+	if err != nil {
+		t.Fatal("Error from ListCheckIns", err)
+	}
+	if len(checkIns) != 1005 {
+		t.Error("Expected every check-in", len(checkIns))
+	}
+}
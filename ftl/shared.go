@@ -0,0 +1,77 @@
+package ftl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func (lr *LocalRepository) sharedPath(packageName string) string {
+	return filepath.Join(lr.BasePath, packageName, "shared")
+}
+
+// linkShared replaces each of the revision's shared paths with a link into
+// the package's shared directory. The first revision to include a shared
+// path provides its initial contents, later revisions' copies are discarded.
+func (lr *LocalRepository) linkShared(revision *RevisionInfo) error {
+	manifest, err := lr.readManifest(revision)
+	if err != nil || manifest == nil {
+		return err
+	}
+
+	owner, err := lr.fileOwner(revision)
+	if err != nil {
+		return err
+	}
+
+	revPath := lr.revisionPath(revision)
+	for _, relPath := range manifest.Shared {
+		relPath = filepath.Clean(relPath)
+		sharedPath := filepath.Join(lr.sharedPath(revision.PackageName), relPath)
+		linkPath := filepath.Join(revPath, relPath)
+
+		_, err = os.Stat(sharedPath)
+		sharedExists := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to check shared path %s: %v", sharedPath, err)
+		}
+
+		_, err = os.Lstat(linkPath)
+		revisionHas := err == nil
+
+		switch {
+		case !sharedExists && revisionHas:
+			err = os.MkdirAll(filepath.Dir(sharedPath), 0755)
+			if err == nil {
+				err = os.Rename(linkPath, sharedPath)
+			}
+		case !sharedExists:
+			err = os.MkdirAll(sharedPath, 0755)
+		case revisionHas:
+			err = os.RemoveAll(linkPath)
+		default:
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to set up shared path %s: %v", relPath, err)
+		}
+
+		if !sharedExists && owner != nil {
+			err = chownTree(sharedPath, owner)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = os.MkdirAll(filepath.Dir(linkPath), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = os.Symlink(sharedPath, linkPath)
+		if err != nil {
+			return fmt.Errorf("Failed linking shared path %s: %v", relPath, err)
+		}
+	}
+	return nil
+}
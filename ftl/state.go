@@ -0,0 +1,405 @@
+package ftl
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"launchpad.net/goamz/s3"
+	"os"
+	"strings"
+	"time"
+)
+
+// How long a master operation may hold the package lock before another
+// operator is allowed to take it over.
+const REMOTE_LOCK_TIMEOUT = 5 * time.Minute
+
+// pointerState holds the current and previous revision of a package in a
+// channel. It is stored as a single object so both pointers always change
+// together.
+type pointerState struct {
+	Current  string `json:"current"`
+	Previous string `json:"previous"`
+}
+
+type remoteLock struct {
+	Owner    string    `json:"owner"`
+	Acquired time.Time `json:"acquired"`
+}
+
+type LockError struct {
+	PackageName string
+	Owner       string
+	Acquired    time.Time
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("Package %s is locked by %s since %s", e.PackageName, e.Owner, e.Acquired.Format(time.RFC3339))
+}
+
+func (rr *RemoteRepository) stateFilePath(packageName string) string {
+	return rr.pointerFilePath(packageName, "state")
+}
+
+func (rr *RemoteRepository) lockFilePath(packageName string) string {
+	return rr.pointerFilePath(packageName, "lock")
+}
+
+// getObject retrieves a key, returning nil data rather than an error if it
+// doesn't exist.
+func (rr *RemoteRepository) getObject(key string) (data []byte, err error) {
+	data, err = rr.bucket.Get(key)
+	if err != nil {
+		if s3Error, ok := err.(*s3.Error); ok && s3Error.StatusCode == 404 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error retrieving %s: %v", key, err)
+	}
+	return
+}
+
+// listChannels finds every channel with pointers for the package, in either
+// the state or the old layout. The default channel and this repository's
+// channel are always included, as their state may be in the oldest layout.
+func (rr *RemoteRepository) listChannels(packageName string) (channels []string, err error) {
+	channels = []string{""}
+	if rr.channel != "" {
+		channels = append(channels, rr.channel)
+	}
+
+	seen := map[string]bool{"": true, rr.channel: true}
+	for _, pointer := range []string{"state", "current", "previous"} {
+		pointerPrefix := rr.key(packageName + "." + pointer + "-")
+		marker := ""
+		for {
+			listResp, e := rr.bucket.List(pointerPrefix, "", marker, 1000)
+			if e != nil {
+				err = fmt.Errorf("Failed listing channels: %v", e)
+				return
+			}
+
+			for _, key := range listResp.Contents {
+				marker = key.Key
+				channel := strings.TrimPrefix(key.Key, pointerPrefix)
+				if !seen[channel] {
+					seen[channel] = true
+					channels = append(channels, channel)
+				}
+			}
+
+			if !listResp.IsTruncated || len(listResp.Contents) == 0 {
+				break
+			}
+		}
+	}
+	return
+}
+
+func (rr *RemoteRepository) getState(packageName string) (state *pointerState, err error) {
+	data, err := rr.getObject(rr.stateFilePath(packageName))
+	if err != nil {
+		return
+	}
+
+	if data == nil {
+		return rr.getLegacyState(packageName)
+	}
+
+	state = &pointerState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		err = fmt.Errorf("Failed to parse state for %s: %v", packageName, err)
+		return
+	}
+	return
+}
+
+// getLegacyState builds state from the separate current and previous files
+// used before pointers were stored together.
+func (rr *RemoteRepository) getLegacyState(packageName string) (state *pointerState, err error) {
+	current, err := rr.legacyCurrentRevisionName(packageName)
+	if err != nil {
+		return
+	}
+
+	previous, err := rr.revisionFromPath(rr.previousRevisionFilePath(packageName))
+	if err != nil {
+		return
+	}
+
+	state = &pointerState{Current: current, Previous: previous}
+	return
+}
+
+func (rr *RemoteRepository) putState(packageName string, state *pointerState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	err = rr.bucket.Put(rr.stateFilePath(packageName), data, "application/json", s3.Private)
+	if err != nil {
+		return fmt.Errorf("Failed to put state file: %v", err)
+	}
+	return nil
+}
+
+func newLockOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	b := make([]byte, 6)
+	rand.Read(b)
+
+	return fmt.Sprintf("%s:%d:%x", hostname, os.Getpid(), b)
+}
+
+func (rr *RemoteRepository) getLock(packageName string) (lock *remoteLock, err error) {
+	data, err := rr.getObject(rr.lockFilePath(packageName))
+	if err != nil || data == nil {
+		return
+	}
+
+	lock = &remoteLock{}
+	err = json.Unmarshal(data, lock)
+	if err != nil {
+		err = fmt.Errorf("Failed to parse lock for %s: %v", packageName, err)
+		return
+	}
+	return
+}
+
+// lock takes a lease on the package's pointers. The goamz client can't send
+// conditional headers, so the lock is best-effort: after writing it we read it
+// back, which catches most operators racing for it, but two writes landing at
+// nearly the same moment can both appear to succeed.
+func (rr *RemoteRepository) lock(packageName string) (unlock func(), err error) {
+	existing, err := rr.getLock(packageName)
+	if err != nil {
+		return
+	}
+
+	if existing != nil {
+		if time.Since(existing.Acquired) < REMOTE_LOCK_TIMEOUT {
+			err = &LockError{packageName, existing.Owner, existing.Acquired}
+			return
+		}
+		fmt.Println("Taking over expired lock held by", existing.Owner)
+	}
+
+	lock := &remoteLock{newLockOwner(), time.Now().UTC()}
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return
+	}
+
+	lockFilePath := rr.lockFilePath(packageName)
+	err = rr.bucket.Put(lockFilePath, data, "application/json", s3.Private)
+	if err != nil {
+		err = fmt.Errorf("Failed to put lock file: %v", err)
+		return
+	}
+
+	check, err := rr.getLock(packageName)
+	if err != nil {
+		return
+	}
+
+	if check == nil || check.Owner != lock.Owner {
+		err = fmt.Errorf("Lost race for lock on %s", packageName)
+		if check != nil {
+			err = &LockError{packageName, check.Owner, check.Acquired}
+		}
+		return
+	}
+
+	unlock = func() {
+		current, e := rr.getLock(packageName)
+		if e == nil && current != nil && current.Owner == lock.Owner {
+			rr.bucket.Del(lockFilePath)
+		}
+	}
+	return
+}
+
+// hasLegacyPointers reports whether the channel still has pointer files from
+// before state objects, which hosts that haven't been upgraded read.
+func (rr *RemoteRepository) hasLegacyPointers(packageName string) (bool, error) {
+	paths := []string{rr.currentRevisionFilePath(packageName), rr.previousRevisionFilePath(packageName)}
+	if rr.channel == "" {
+		paths = append(paths, rr.currentRevisionFilePathOld(packageName))
+	}
+
+	for _, path := range paths {
+		data, err := rr.getObject(path)
+		if err != nil {
+			return false, err
+		}
+		if data != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// putLegacyPointers writes state to the pointer files older versions read.
+func (rr *RemoteRepository) putLegacyPointers(packageName string, state *pointerState) error {
+	err := rr.bucket.Put(rr.currentRevisionFilePath(packageName), []byte(state.Current), "text/plain", s3.Private)
+	if err != nil {
+		return fmt.Errorf("Failed to put current rev file: %v", err)
+	}
+
+	previousFilePath := rr.previousRevisionFilePath(packageName)
+	if state.Previous == "" {
+		err = rr.bucket.Del(previousFilePath)
+	} else {
+		err = rr.bucket.Put(previousFilePath, []byte(state.Previous), "text/plain", s3.Private)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to put previous rev file: %v", err)
+	}
+	return nil
+}
+
+// updateState applies update to the package's pointers while holding the
+// package lock. Until the package is migrated, its old pointer files are kept
+// up to date too, so hosts that haven't been upgraded still follow jumps.
+func (rr *RemoteRepository) updateState(packageName string, update func(state *pointerState) error) error {
+	unlock, err := rr.lock(packageName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := rr.getState(packageName)
+	if err != nil {
+		return err
+	}
+
+	legacy, err := rr.hasLegacyPointers(packageName)
+	if err != nil {
+		return err
+	}
+
+	err = update(state)
+	if err != nil {
+		return err
+	}
+
+	err = rr.putState(packageName, state)
+	if err != nil || !legacy {
+		return err
+	}
+
+	return rr.putLegacyPointers(packageName, state)
+}
+
+// legacyChannels finds the channels of a package that still have pointer
+// files from before state objects, and whether each already has state. Only
+// the pointer keys are listed, as revisions sort before them.
+func (rr *RemoteRepository) legacyChannels(packageName string) (legacy map[string]bool, err error) {
+	pkgPrefix := rr.key(packageName + ".")
+	legacy = make(map[string]bool)
+	hasState := make(map[string]bool)
+
+	for _, pointer := range []string{"rev", "current", "previous", "state"} {
+		e := rr.listKeys(pkgPrefix+pointer, func(key s3.Key) {
+			name := strings.TrimPrefix(key.Key, pkgPrefix)
+			parts := strings.SplitN(name, "-", 2)
+			if parts[0] != pointer {
+				// Something else that starts the same way
+				return
+			}
+
+			channel := ""
+			if len(parts) > 1 {
+				channel = parts[1]
+			}
+
+			switch pointer {
+			case "rev":
+				if channel == "" {
+					legacy[channel] = true
+				}
+			case "current", "previous":
+				legacy[channel] = true
+			case "state":
+				hasState[channel] = true
+			}
+		})
+		if e != nil {
+			err = fmt.Errorf("Failed listing %s: %v", packageName, e)
+			return
+		}
+	}
+
+	for channel := range legacy {
+		legacy[channel] = hasState[channel]
+	}
+	return
+}
+
+func (rr *RemoteRepository) deleteLegacyPointers(packageName string) error {
+	paths := []string{rr.currentRevisionFilePath(packageName), rr.previousRevisionFilePath(packageName)}
+	if rr.channel == "" {
+		paths = append(paths, rr.currentRevisionFilePathOld(packageName))
+	}
+
+	for _, path := range paths {
+		err := rr.bucket.Del(path)
+		if err != nil {
+			return fmt.Errorf("Failed to remove %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// Migrate moves a package's pointers from the separate current, previous and
+// rev files of older versions into state objects, then removes the old files.
+// Channels that already have state just have their old files removed. With
+// dryRun set, it only reports what it would do.
+func (rr *RemoteRepository) Migrate(packageName string, dryRun bool) error {
+	legacy, err := rr.legacyChannels(packageName)
+	if err != nil {
+		return err
+	}
+
+	for channel, hasState := range legacy {
+		channelRepo := rr.Channel(channel)
+		label := fmt.Sprintf("%s (channel %s)", packageName, channelDisplayName(channel))
+
+		if hasState {
+			fmt.Println(label, "already migrated, removing old pointer files")
+		} else {
+			state, err := channelRepo.getLegacyState(packageName)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s current=%q previous=%q\n", label, state.Current, state.Previous)
+		}
+
+		if dryRun {
+			continue
+		}
+
+		if !hasState {
+			// Nothing to change, updateState starts from the old files and
+			// writes them out as its state.
+			err = channelRepo.updateState(packageName, func(state *pointerState) error {
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = channelRepo.deleteLegacyPointers(packageName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
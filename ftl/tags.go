@@ -0,0 +1,178 @@
+package ftl
+
+import (
+	"encoding/json"
+	"fmt"
+	"launchpad.net/goamz/s3"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Refers to the newest revision of a package, as in "my_site@latest".
+const LATEST_TAG = "latest"
+
+var tagNameRe = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+func ValidTagName(name string) bool {
+	return name != LATEST_TAG && tagNameRe.MatchString(name)
+}
+
+func (rr *RemoteRepository) tagsFilePath(packageName string) string {
+	return rr.key(fmt.Sprintf("%s.tags", packageName))
+}
+
+// GetTags returns the package's tags, mapping each to a revision name.
+func (rr *RemoteRepository) GetTags(packageName string) (tags map[string]string, err error) {
+	data, err := rr.getObject(rr.tagsFilePath(packageName))
+	if err != nil {
+		return
+	}
+
+	tags = make(map[string]string)
+	if data == nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &tags)
+	if err != nil {
+		err = fmt.Errorf("Failed to parse tags for %s: %v", packageName, err)
+	}
+	return
+}
+
+// TagsFor returns the sorted names of every tag pointing at revision.
+func (rr *RemoteRepository) TagsFor(revision *RevisionInfo) (names []string, err error) {
+	tags, err := rr.GetTags(revision.PackageName)
+	if err != nil {
+		return
+	}
+
+	for tag, revisionName := range tags {
+		if revisionName == revision.Name() {
+			names = append(names, tag)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// updateTags applies update to the package's tags while holding the default
+// channel's package lock.
+func (rr *RemoteRepository) updateTags(packageName string, update func(tags map[string]string) error) error {
+	unlock, err := rr.Channel("").lock(packageName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tags, err := rr.GetTags(packageName)
+	if err != nil {
+		return err
+	}
+
+	err = update(tags)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+
+	err = rr.bucket.Put(rr.tagsFilePath(packageName), data, "application/json", s3.Private)
+	if err != nil {
+		return fmt.Errorf("Failed to put tags file: %v", err)
+	}
+	return nil
+}
+
+// Tag points the named tag at revision, moving it if it already exists.
+func (rr *RemoteRepository) Tag(revision *RevisionInfo, tag string) error {
+	if !ValidTagName(tag) {
+		return fmt.Errorf("Invalid tag name: %s", tag)
+	}
+
+	key, err := rr.findRevisionKey(revision)
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		return fmt.Errorf("Revision %s does not exist", revision.Name())
+	}
+
+	entry := &AuditEntry{Action: AUDIT_TAG, Revision: revision.Name(), Tag: tag}
+	err = rr.updateTags(revision.PackageName, func(tags map[string]string) error {
+		if existing, ok := tags[tag]; ok && existing != revision.Name() {
+			fmt.Printf("Moving tag %s from %s\n", tag, existing)
+			entry.Previous = existing
+		}
+		tags[tag] = revision.Name()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	rr.audit(revision.PackageName, entry)
+	return nil
+}
+
+// untagRevision removes every tag pointing at revision.
+func (rr *RemoteRepository) untagRevision(revision *RevisionInfo) error {
+	names, err := rr.TagsFor(revision)
+	if err != nil || len(names) == 0 {
+		return err
+	}
+
+	return rr.updateTags(revision.PackageName, func(tags map[string]string) error {
+		for _, name := range names {
+			delete(tags, name)
+		}
+		return nil
+	})
+}
+
+// ResolveRevision turns anything a user may use to name a revision into a
+// RevisionInfo. Along with full revision names, it accepts "<package>@<tag>"
+// and "<package>@latest".
+func (rr *RemoteRepository) ResolveRevision(name string) (*RevisionInfo, error) {
+	at := strings.Index(name, "@")
+	if at < 0 {
+		return NewRevisionInfo(name)
+	}
+
+	packageName, tag := name[:at], name[at+1:]
+	if !ValidPackageName(packageName) {
+		return nil, fmt.Errorf("Invalid package name %q", packageName)
+	}
+
+	if tag == LATEST_TAG {
+		// Revisions list oldest first, across every page of the bucket
+		// listing, so the newest is last.
+		revisions, err := rr.ListRevisions(packageName)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(revisions) == 0 {
+			return nil, fmt.Errorf("Package %s has no revisions", packageName)
+		}
+
+		return revisions[len(revisions)-1], nil
+	}
+
+	tags, err := rr.GetTags(packageName)
+	if err != nil {
+		return nil, err
+	}
+
+	revisionName, ok := tags[tag]
+	if !ok {
+		return nil, fmt.Errorf("Package %s has no tag %s", packageName, tag)
+	}
+
+	return NewRevisionInfo(revisionName)
+}
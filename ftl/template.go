@@ -0,0 +1,222 @@
+package ftl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"text/template"
+)
+
+// Values for rendering a package's templates on this host
+const PKG_VALUES_FILE = "values.json"
+
+// Suffix of template files, which render to the same path without it
+const TEMPLATE_SUFFIX = ".tmpl"
+
+// HostFacts describe the host a revision is installed on.
+type HostFacts struct {
+	Hostname string
+
+	// Non-loopback IP addresses
+	Addresses []string
+
+	OS   string
+	Arch string
+	CPUs int
+}
+
+// TemplateData is what a package's templates are rendered with. It leaves
+// out our environment, which holds our AWS credentials.
+type TemplateData struct {
+	Package  string
+	Revision string
+	Host     HostFacts
+	Values   map[string]interface{}
+}
+
+func hostFacts() (facts HostFacts, err error) {
+	facts.Hostname, err = os.Hostname()
+	if err != nil {
+		return
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			facts.Addresses = append(facts.Addresses, ipNet.IP.String())
+		}
+	}
+
+	facts.OS = runtime.GOOS
+	facts.Arch = runtime.GOARCH
+	facts.CPUs = runtime.NumCPU()
+	return
+}
+
+// PackageValues reads the package's values file. A package without one has
+// no values.
+func (lr *LocalRepository) PackageValues(packageName string) (values map[string]interface{}, err error) {
+	valuesPath := filepath.Join(lr.BasePath, packageName, PKG_VALUES_FILE)
+	values = make(map[string]interface{})
+
+	data, err := ioutil.ReadFile(valuesPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = json.Unmarshal(data, &values)
+	if err != nil {
+		err = fmt.Errorf("Failed to parse %s: %v", valuesPath, err)
+	}
+	return
+}
+
+func (lr *LocalRepository) templateData(revision *RevisionInfo) (data *TemplateData, err error) {
+	data = &TemplateData{
+		Package:  revision.PackageName,
+		Revision: revision.Name(),
+	}
+
+	data.Host, err = hostFacts()
+	if err != nil {
+		err = fmt.Errorf("Failed to gather host facts: %v", err)
+		return
+	}
+
+	data.Values, err = lr.PackageValues(revision.PackageName)
+	return
+}
+
+// RenderTemplates renders each template declared in the revision's manifest
+// to the same path without its suffix. Templates referring to missing values
+// fail rather than rendering empty strings.
+func (lr *LocalRepository) RenderTemplates(revision *RevisionInfo) error {
+	manifest, err := lr.readManifest(revision)
+	if err != nil || manifest == nil || len(manifest.Templates) == 0 {
+		return err
+	}
+
+	data, err := lr.templateData(revision)
+	if err != nil {
+		return err
+	}
+
+	owner, err := lr.fileOwner(revision)
+	if err != nil {
+		return err
+	}
+
+	revPath := lr.revisionPath(revision)
+	for _, relPath := range manifest.Templates {
+		err = renderTemplate(revPath, filepath.Clean(relPath), data, owner)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNoSymlinks makes sure no part of relPath inside dir is a symlink, so
+// reading or writing it can't be redirected outside the revision. A missing
+// final component is fine.
+func checkNoSymlinks(dir, relPath string) error {
+	path := dir
+	for _, part := range strings.Split(relPath, string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) && path == filepath.Join(dir, relPath) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", path)
+		}
+	}
+	return nil
+}
+
+// renderTemplate renders the template at relPath in revPath. We run as root
+// and scripts may not, so neither the template nor its output may be a
+// symlink, and the output is written to a temporary file then renamed into
+// place.
+func renderTemplate(revPath, relPath string, data *TemplateData, owner *scriptUser) error {
+	templatePath := filepath.Join(revPath, relPath)
+	outputPath := strings.TrimSuffix(templatePath, TEMPLATE_SUFFIX)
+
+	err := checkNoSymlinks(revPath, relPath)
+	if err == nil {
+		err = checkNoSymlinks(revPath, strings.TrimSuffix(relPath, TEMPLATE_SUFFIX))
+	}
+	if err != nil {
+		return fmt.Errorf("Refusing to render template %s: %v", relPath, err)
+	}
+
+	f, err := os.OpenFile(templatePath, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to read template %s: %v", relPath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Failed to read template %s: %v", relPath, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("Template %s is not a regular file", relPath)
+	}
+
+	text, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("Failed to read template %s: %v", relPath, err)
+	}
+
+	tmpl, err := template.New(filepath.Base(relPath)).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return fmt.Errorf("Failed to parse template %s: %v", relPath, err)
+	}
+
+	buf := new(bytes.Buffer)
+	err = tmpl.Execute(buf, data)
+	if err != nil {
+		return fmt.Errorf("Failed to render template %s: %v", relPath, err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".")
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %v", outputPath, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil && owner != nil {
+		err = tmp.Chown(int(owner.Uid), int(owner.Gid))
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), outputPath)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %v", outputPath, err)
+	}
+	return nil
+}
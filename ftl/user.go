@@ -0,0 +1,169 @@
+package ftl
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// scriptUser is who a package's scripts run as, when it isn't us.
+type scriptUser struct {
+	Name string
+	Home string
+	Uid  uint32
+	Gid  uint32
+
+	// Supplementary groups
+	Groups []uint32
+}
+
+func parseId(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err
+}
+
+// lookupScriptUser finds a user, and optionally a group, by name or id. The
+// user's primary group is used if group is empty.
+func lookupScriptUser(userName, groupName string) (su *scriptUser, err error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		var e error
+		u, e = user.LookupId(userName)
+		if e != nil {
+			err = fmt.Errorf("Unknown user %s", userName)
+			return
+		}
+		err = nil
+	}
+
+	su = &scriptUser{Name: u.Username, Home: u.HomeDir}
+	su.Uid, err = parseId(u.Uid)
+	if err != nil {
+		return
+	}
+
+	gid := u.Gid
+	if groupName != "" {
+		g, e := user.LookupGroup(groupName)
+		if e != nil {
+			g, e = user.LookupGroupId(groupName)
+			if e != nil {
+				err = fmt.Errorf("Unknown group %s", groupName)
+				return
+			}
+		}
+		gid = g.Gid
+	}
+
+	su.Gid, err = parseId(gid)
+	if err != nil {
+		return
+	}
+
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		// Not every system can list them, the primary group will do
+		err = nil
+	}
+	for _, groupId := range groupIds {
+		id, e := parseId(groupId)
+		if e == nil {
+			su.Groups = append(su.Groups, id)
+		}
+	}
+	return
+}
+
+// scriptUser returns who the revision's scripts run as, or nil to run them as
+// ourselves. The package's config takes precedence over its manifest.
+func (lr *LocalRepository) scriptUser(revision *RevisionInfo) (su *scriptUser, err error) {
+	config, err := lr.PackageConfig(revision.PackageName)
+	if err != nil {
+		return
+	}
+
+	userName, groupName := config.User, config.Group
+	if userName == "" {
+		manifest, e := lr.readManifest(revision)
+		if e != nil {
+			err = e
+			return
+		}
+		if manifest != nil {
+			userName, groupName = manifest.User, manifest.Group
+		}
+	}
+
+	if userName == "" {
+		return
+	}
+
+	su, err = lookupScriptUser(userName, groupName)
+	if err != nil {
+		err = fmt.Errorf("Can't run %s scripts: %v", revision.Name(), err)
+	}
+	return
+}
+
+func (su *scriptUser) credential() *syscall.Credential {
+	return &syscall.Credential{Uid: su.Uid, Gid: su.Gid, Groups: su.Groups}
+}
+
+// env returns environ, without anything that gives access to the bucket,
+// with the user's own details added.
+func (su *scriptUser) env(environ []string) (env []string) {
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, "AWS_") || strings.HasPrefix(kv, "FTL_BUCKET=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env, "USER="+su.Name, "LOGNAME="+su.Name, "HOME="+su.Home)
+}
+
+// fileOwner returns who the package's files should belong to, or nil if
+// the package's config doesn't ask for them to be given away.
+func (lr *LocalRepository) fileOwner(revision *RevisionInfo) (su *scriptUser, err error) {
+	config, err := lr.PackageConfig(revision.PackageName)
+	if err != nil || !config.Chown {
+		return
+	}
+
+	su, err = lr.scriptUser(revision)
+	if err == nil && su == nil {
+		err = fmt.Errorf("%s sets chown, but no user for %s", PKG_CONFIG_FILE, revision.Name())
+	}
+	return
+}
+
+// chownTree gives everything in root to su, leaving out root itself and our
+// log. Keeping root ours means scripts can't replace the files we write at
+// the top of the revision, such as the log, with symlinks.
+func chownTree(root string, su *scriptUser) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == root || info.Name() == PKG_SCRIPT_LOG {
+			return nil
+		}
+
+		return os.Lchown(path, int(su.Uid), int(su.Gid))
+	})
+}
+
+// chownRevision gives the revision's files to the user its scripts run as,
+// if the package's config asks for it.
+func (lr *LocalRepository) chownRevision(revision *RevisionInfo) error {
+	su, err := lr.fileOwner(revision)
+	if err != nil || su == nil {
+		return err
+	}
+
+	return chownTree(lr.revisionPath(revision), su)
+}
@@ -5,15 +5,39 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"os"
+	"regexp"
 	"strings"
 )
 
+// Package and channel names end up in S3 keys and directory names, and are
+// separated from the rest of a key by a dot, so they are kept simple.
+var nameRe = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// Revision ids are a timestamp followed by characters of our hash encoding.
+var revisionIdRe = regexp.MustCompile("^[A-Za-z0-9_]+$")
+
+func ValidPackageName(name string) bool {
+	return nameRe.MatchString(name)
+}
+
+func ValidChannelName(name string) bool {
+	return name == "" || nameRe.MatchString(name)
+}
+
+func channelDisplayName(name string) string {
+	if name == "" {
+		return "(default)"
+	}
+	return name
+}
+
 func encodeBytes(b []byte) (s string) {
 	// Note that this encoding is not decodable, as we are using '0' for two different bytes.
 	// This is much safer for using these as parts of file names.
-	enc := base64.NewEncoding("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz0")
-	s = enc.EncodeToString(b)
+	// Newer versions of encoding/base64 refuse an alphabet with duplicates, so
+	// encode with '-' in the last position and swap it for '0' afterwards.
+	enc := base64.NewEncoding("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz-")
+	s = strings.Replace(enc.EncodeToString(b), "-", "0", -1)
 	return
 }
 
@@ -22,14 +46,22 @@ type RevisionInfo struct {
 	Revision    string
 }
 
-func NewRevisionInfo(revisionName string) *RevisionInfo {
-	parts := strings.Split(revisionName, ".")
+// NewRevisionInfo parses a revision name of the form "<package>.<revision id>".
+func NewRevisionInfo(revisionName string) (*RevisionInfo, error) {
+	parts := strings.SplitN(revisionName, ".", 2)
 	if len(parts) < 2 {
-		fmt.Println("Failed to parse revision", revisionName)
-		return nil
+		return nil, fmt.Errorf("Invalid revision name %q: expected <package>.<revision>", revisionName)
+	}
+
+	if !ValidPackageName(parts[0]) {
+		return nil, fmt.Errorf("Invalid package name %q in revision %q", parts[0], revisionName)
+	}
+
+	if !revisionIdRe.MatchString(parts[1]) {
+		return nil, fmt.Errorf("Invalid revision id %q in revision %q", parts[1], revisionName)
 	}
 
-	return &RevisionInfo{parts[0], parts[1]}
+	return &RevisionInfo{parts[0], parts[1]}, nil
 }
 
 func (ri *RevisionInfo) Name() string {
@@ -41,7 +73,7 @@ type RevisionListResult struct {
 	Err       error
 }
 
-func fileHashPrefix(file *os.File) (string, error) {
+func fileHash(file io.ReadSeeker) ([]byte, error) {
 	defer file.Seek(0, 0)
 
 	h := md5.New()
@@ -49,9 +81,21 @@ func fileHashPrefix(file *os.File) (string, error) {
 	_, err := io.Copy(h, file)
 	if err != nil {
 		fmt.Println("Error copying file", err)
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+func hashPrefix(sum []byte) string {
+	return encodeBytes(sum)[:2]
+}
+
+func fileHashPrefix(file io.ReadSeeker) (string, error) {
+	sum, err := fileHash(file)
+	if err != nil {
 		return "", err
 	}
 
-	hashEncode := encodeBytes(h.Sum(nil))
-	return hashEncode[:2], nil
+	return hashPrefix(sum), nil
 }
@@ -0,0 +1,25 @@
+package ftl
+
+import (
+	"testing"
+)
+
+func Test_NewRevisionInfo(t *testing.T) {
+	revision, err := NewRevisionInfo("my_site.2014061038400aR")
+	if err != nil {
+		t.Fatal("Error from NewRevisionInfo", err)
+	}
+
+	if revision.PackageName != "my_site" || revision.Revision != "2014061038400aR" {
+		t.Error("Unexpected revision", revision)
+	}
+}
+
+func Test_NewRevisionInfo_invalid(t *testing.T) {
+	for _, name := range []string{"my_site", "my.site.2014061038400aR", "my site.2014061038400aR", ".2014061038400aR", "my_site."} {
+		revision, err := NewRevisionInfo(name)
+		if err == nil {
+			t.Error("Expected error parsing", name, revision)
+		}
+	}
+}
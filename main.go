@@ -4,15 +4,30 @@ import "fmt"
 import "os"
 
 import (
+	"bytes"
 	goopt "github.com/droundy/goopt"
 	"github.com/rhettg/ftl/ftl"
+	"io"
+	"io/ioutil"
 	"launchpad.net/goamz/aws"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const DOWNLOAD_WORKERS = 4
 
+// Hosts that haven't checked in for this long aren't waited for on release
+const CHECKIN_MAX_AGE = 24 * time.Hour
+
+const RELEASE_POLL_INTERVAL = 10 * time.Second
+
+// How often release checks on hosts. Tests shorten it.
+var releasePollInterval = RELEASE_POLL_INTERVAL
+
+// Exit status when a revision fails its health check
+const HEALTHCHECK_EXIT_STATUS = 3
+
 const Version = "0.2.6"
 
 var amVerbose = goopt.Flag([]string{"-v", "--verbose"}, []string{"--quiet"},
@@ -22,6 +37,36 @@ var amMaster = goopt.Flag([]string{"--master"}, nil, "Execute against master rep
 
 var amVersion = goopt.Flag([]string{"--version"}, nil, "Display current version", "")
 
+var amForce = goopt.Flag([]string{"--force"}, nil, "Force a master jump to an unverified revision, a master purge of the previous revision, or a sync to a revision that failed its health check", "")
+
+var amDryRun = goopt.Flag([]string{"--dry-run"}, nil, "Show what migrate would do without changing anything", "")
+
+var amLong = goopt.Flag([]string{"-l", "--long"}, nil, "List revisions with their metadata", "")
+
+var metaOpts = goopt.Strings([]string{"--meta"}, "key=value", "Metadata to record with a spooled revision")
+
+var packageOpt = goopt.String([]string{"--package"}, "", "Package name to spool as (required for directories and stdin)")
+
+var amAllowDuplicate = goopt.Flag([]string{"--allow-duplicate"}, nil, "Spool a new revision even if an identical one exists", "")
+
+var releaseTag = goopt.String([]string{"--tag"}, "", "Tag to attach to a released revision")
+
+var releaseHosts = goopt.String([]string{"--hosts"}, "", "Comma separated hosts a release waits for (default every recently synced host)")
+
+var releaseWaitPercent = goopt.Int([]string{"--wait-percent"}, 100, "Percentage of hosts that must be running a release for it to succeed")
+
+var releaseTimeout = goopt.String([]string{"--timeout"}, "10m", "How long a release waits for hosts before jumping back")
+
+var auditMessage = goopt.String([]string{"--message"}, "", "Why a master jump, jump-back, purge or tag is being made, recorded in the package's history")
+
+var rollbackSteps = goopt.Int([]string{"--steps"}, 1, "How many activated revisions to roll back")
+
+var syncKeep = goopt.Int([]string{"--keep"}, 3, "How many recently activated revisions sync keeps installed, even if purged from master")
+
+var fromChannel = goopt.String([]string{"--from"}, "", "Channel to promote from (default channel if empty)")
+
+var toChannel = goopt.String([]string{"--to"}, "", "Channel to promote to (default channel if empty)")
+
 func optToRegion(regionName string) (region aws.Region) {
 	region = aws.USEast
 
@@ -42,21 +87,100 @@ func optFail(message string) {
 	os.Exit(1)
 }
 
-func spoolCmd(rr *ftl.RemoteRepository, fileName string) error {
-	file, err := os.Open(fileName)
+func parseMetaOpts(opts []string, source string) (meta ftl.RevisionMeta, err error) {
+	meta = ftl.CaptureRevisionMeta(source)
+	for _, opt := range opts {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid metadata %q, expected key=value", opt)
+		}
+		meta[parts[0]] = parts[1]
+	}
+	return
+}
+
+// archiveExtension works out what kind of archive data holds, as there's no
+// file name to go on when spooling from stdin.
+func archiveExtension(data []byte) (string, error) {
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		return "tar.gz", nil
+	}
+	if len(data) > 262 && string(data[257:262]) == "ustar" {
+		return "tar", nil
+	}
+	return "", fmt.Errorf("Input is not a tar or gzipped tar archive")
+}
+
+// spool spools source, which may be an archive, a directory to tar up, or "-"
+// to read an archive from stdin. Directories and stdin are buffered in memory
+// as we need the hash of the content before uploading.
+func spool(rr *ftl.RemoteRepository, source, packageName string, meta ftl.RevisionMeta) (*ftl.RevisionInfo, error) {
+	if source == "-" {
+		if packageName == "" {
+			return nil, fmt.Errorf("--package is required when spooling from stdin")
+		}
+
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading stdin: %v", err)
+		}
+
+		ext, err := archiveExtension(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return spoolReader(rr, packageName, "stdin."+ext, bytes.NewReader(data), int64(len(data)), meta)
+	}
+
+	file, err := os.Open(source)
 	if err != nil {
-		return fmt.Errorf("Error opening file: %v", err)
+		return nil, fmt.Errorf("Error opening file: %v", err)
 	}
 
 	defer file.Close()
 
-	name := filepath.Base(fileName)
-	parts := strings.Split(name, ".")
-	packageName := parts[0]
+	statInfo, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Error stating file: %v", err)
+	}
 
-	revision, err := rr.Spool(packageName, file)
+	if statInfo.IsDir() {
+		if packageName == "" {
+			return nil, fmt.Errorf("--package is required when spooling a directory")
+		}
+
+		buf := new(bytes.Buffer)
+		err = ftl.TarDirectory(source, buf)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to tar %s: %v", source, err)
+		}
+
+		return spoolReader(rr, packageName, packageName+".tar.gz", bytes.NewReader(buf.Bytes()), int64(buf.Len()), meta)
+	}
+
+	name := filepath.Base(source)
+	if packageName == "" {
+		parts := strings.Split(name, ".")
+		packageName = parts[0]
+	}
+
+	return spoolReader(rr, packageName, name, file, statInfo.Size(), meta)
+}
+
+func spoolReader(rr *ftl.RemoteRepository, packageName, fileName string, r io.ReadSeeker, size int64, meta ftl.RevisionMeta) (*ftl.RevisionInfo, error) {
+	revision, err := rr.Spool(packageName, fileName, r, size, meta, *amAllowDuplicate)
 	if err != nil {
-		return fmt.Errorf("Failed to spool: %v", err)
+		return nil, fmt.Errorf("Failed to spool: %v", err)
+	}
+
+	return revision, nil
+}
+
+func spoolCmd(rr *ftl.RemoteRepository, source, packageName string, meta ftl.RevisionMeta) error {
+	revision, err := spool(rr, source, packageName, meta)
+	if err != nil {
+		return err
 	}
 
 	fmt.Println(revision.Name())
@@ -118,6 +242,24 @@ func syncPackage(remoteRevisions, localRevisions []*ftl.RevisionInfo, startRev *
 	return
 }
 
+// keepRecent removes recently activated revisions from those to purge, so
+// we can roll back to them.
+func keepRecent(purgeRevs, recentRevs []*ftl.RevisionInfo) (remaining []*ftl.RevisionInfo) {
+	for _, purgeRev := range purgeRevs {
+		recent := false
+		for _, recentRev := range recentRevs {
+			if *recentRev == *purgeRev {
+				recent = true
+			}
+		}
+
+		if !recent {
+			remaining = append(remaining, purgeRev)
+		}
+	}
+	return
+}
+
 func retrieveRemoteRevisions(r *ftl.RemoteRepository, packageName string) (curRev, prevRev *ftl.RevisionInfo, revisions []*ftl.RevisionInfo, err error) {
 	crChan := make(chan ftl.RevisionListResult)
 	go func() {
@@ -161,38 +303,50 @@ func retrieveRemoteRevisions(r *ftl.RemoteRepository, packageName string) (curRe
 	return
 }
 
-func downloadRemoteRevisions(r *ftl.RemoteRepository, l *ftl.LocalRepository, revisions []*ftl.RevisionInfo) error {
+// downloadRemoteRevisions adds the revisions locally, returning those that
+// failed.
+func downloadRemoteRevisions(r *ftl.RemoteRepository, l *ftl.LocalRepository, revisions []*ftl.RevisionInfo) (failed map[ftl.RevisionInfo]bool, err error) {
 	workerChan := make(chan bool, DOWNLOAD_WORKERS)
 	for i := 0; i < DOWNLOAD_WORKERS; i++ {
 		workerChan <- true
 	}
 
-	downloadChan := make(chan error)
+	type download struct {
+		rev *ftl.RevisionInfo
+		err error
+	}
+
+	downloadChan := make(chan download)
 	for _, rev := range revisions {
 		rev := rev
 		go func() {
 			<-workerChan
-			downloadChan <- downloadPackageRevision(r, l, rev)
+			downloadChan <- download{rev, downloadPackageRevision(r, l, rev)}
 			workerChan <- true
 		}()
 	}
 
-	errList := make([]error, 0, len(revisions))
+	failed = make(map[ftl.RevisionInfo]bool)
 	for _ = range revisions {
-		err := <-downloadChan
-		errList = append(errList, err)
-	}
-
-	for _, err := range errList {
-		if err != nil {
-			return fmt.Errorf("Failed downloading revisions")
+		d := <-downloadChan
+		if d.err != nil {
+			fmt.Println(d.err)
+			failed[*d.rev] = true
 		}
 	}
 
-	return nil
+	if len(failed) > 0 {
+		err = fmt.Errorf("Failed downloading revisions")
+	}
+	return
 }
 
-func syncCmd(remote *ftl.RemoteRepository, local *ftl.LocalRepository) error {
+func syncCmd(remote *ftl.RemoteRepository, local *ftl.LocalRepository, keep int) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("Failed to find hostname: %v", err)
+	}
+
 	for _, packageName := range local.ListPackages() {
 		err := local.CheckPackage(packageName)
 		if err != nil {
@@ -222,16 +376,57 @@ func syncCmd(remote *ftl.RemoteRepository, local *ftl.LocalRepository) error {
 			return err
 		}
 
-		err = downloadRemoteRevisions(remote, local, download)
+		recent, err := local.RecentRevisions(packageName, keep)
+		if err != nil {
+			return err
+		}
+		purge = keepRecent(purge, recent)
+
+		failed, err := downloadRemoteRevisions(remote, local, download)
+
+		if curRev != nil && failed[*curRev] {
+			// Stay on what we have rather than jumping to a revision that
+			// isn't installed
+			return fmt.Errorf("Not jumping to %s, it failed to install", curRev.Name())
+		}
+
+		// A revision that failed its health check here isn't tried again
+		// until master moves on, or we're forced, so hosts don't flap.
+		unhealthyRev, err := local.UnhealthyRevision(packageName)
+		if err != nil {
+			return err
+		}
+
+		if unhealthyRev != nil && (curRev == nil || *unhealthyRev != *curRev || *amForce) {
+			err = local.SetUnhealthyRevision(packageName, nil)
+			if err != nil {
+				return err
+			}
+			unhealthyRev = nil
+		}
 
-		if curRev != nil {
+		if unhealthyRev != nil {
+			fmt.Println("Not jumping to", curRev.Name(), "as it failed its health check, use --force to try again")
+		} else if curRev != nil {
 			err = local.Jump(curRev)
 			if err != nil {
+				if _, ok := err.(*ftl.HealthCheckError); ok {
+					fmt.Println("Host is unhealthy running", curRev.Name())
+					setErr := local.SetUnhealthyRevision(packageName, curRev)
+					if setErr != nil {
+						fmt.Println("Failed to record unhealthy revision", setErr)
+					}
+
+					checkInErr := remote.CheckIn(packageName, hostname, local.GetCurrentRevision(packageName), curRev)
+					if checkInErr != nil {
+						fmt.Println("Failed to check in", checkInErr)
+					}
+				}
 				return err
 			}
 		}
 
-		if prevRev != nil {
+		if prevRev != nil && unhealthyRev == nil {
 			err = local.SetPreviousJump(prevRev)
 			if err != nil {
 				return err
@@ -244,10 +439,138 @@ func syncCmd(remote *ftl.RemoteRepository, local *ftl.LocalRepository) error {
 				return err
 			}
 		}
+
+		err = remote.CheckIn(packageName, hostname, local.GetCurrentRevision(packageName), unhealthyRev)
+		if err != nil {
+			fmt.Println("Failed to check in", err)
+		}
 	}
 	return nil
 }
 
+// recentHosts returns every host that has checked in for the package lately.
+func recentHosts(remote *ftl.RemoteRepository, packageName string) (hosts []string, err error) {
+	checkIns, err := remote.ListCheckIns(packageName)
+	if err != nil {
+		return
+	}
+
+	for _, checkIn := range checkIns {
+		if time.Since(checkIn.Time) < CHECKIN_MAX_AGE {
+			hosts = append(hosts, checkIn.Host)
+		}
+	}
+	return
+}
+
+// waitForHosts polls host check-ins until waitPercent of hosts report revision
+// as current, or timeout passes. Hosts that haven't checked in since are
+// reported, as a host that can't write its check-ins never looks ready.
+func waitForHosts(remote *ftl.RemoteRepository, revision *ftl.RevisionInfo, hosts []string, since time.Time, waitPercent int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		checkIns, err := remote.ListCheckIns(revision.PackageName)
+		if err != nil {
+			return err
+		}
+
+		hostRevisions := make(map[string]string)
+		hostFailures := make(map[string]string)
+		heardFrom := make(map[string]bool)
+		for _, checkIn := range checkIns {
+			hostRevisions[checkIn.Host] = checkIn.Revision
+			hostFailures[checkIn.Host] = checkIn.Failed
+			heardFrom[checkIn.Host] = checkIn.Time.After(since)
+		}
+
+		for _, host := range hosts {
+			if hostFailures[host] == revision.Name() {
+				return fmt.Errorf("%s failed its health check running %s", host, revision.Name())
+			}
+		}
+
+		ready, silent := 0, 0
+		for _, host := range hosts {
+			if hostRevisions[host] == revision.Name() {
+				ready++
+			}
+			if !heardFrom[host] {
+				silent++
+			}
+		}
+
+		fmt.Printf("%d/%d hosts running %s, %d not heard from\n", ready, len(hosts), revision.Name(), silent)
+		if ready*100 >= waitPercent*len(hosts) {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for hosts to run %s, %d of %d hosts never checked in", revision.Name(), silent, len(hosts))
+		}
+
+		time.Sleep(releasePollInterval)
+	}
+}
+
+// releaseCmd spools source, tags it, makes it current on master, then waits
+// for the fleet to pick it up. If it doesn't in time, master jumps back.
+func releaseCmd(remote *ftl.RemoteRepository, source, packageName string, meta ftl.RevisionMeta, tag string, hosts []string, waitPercent int, timeout time.Duration) error {
+	revision, err := spool(remote, source, packageName, meta)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Spooled", revision.Name())
+
+	if tag != "" {
+		err = remote.Tag(revision, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	currentRevision, err := remote.GetCurrentRevision(revision.PackageName)
+	if err != nil {
+		return err
+	}
+
+	if currentRevision != nil && *currentRevision == *revision {
+		fmt.Println(revision.Name(), "is already current")
+		return nil
+	}
+
+	if len(hosts) == 0 {
+		hosts, err = recentHosts(remote, revision.PackageName)
+		if err != nil {
+			return err
+		}
+	}
+
+	jumpedAt := time.Now()
+	err = remote.Jump(revision, false)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Jumped master to", revision.Name())
+
+	if len(hosts) == 0 {
+		fmt.Println("No hosts to wait for")
+		return nil
+	}
+
+	err = waitForHosts(remote, revision, hosts, jumpedAt, waitPercent, timeout)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("Jumping master back")
+		jumpBackErr := remote.JumpBack(revision.PackageName)
+		if jumpBackErr != nil {
+			return fmt.Errorf("%v, and jump-back failed: %v", err, jumpBackErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
 func jumpCmd(lr *ftl.LocalRepository, revision *ftl.RevisionInfo) error {
 	err := lr.Jump(revision)
 	if err != nil {
@@ -268,7 +591,188 @@ func listCmd(lr *ftl.LocalRepository, packageName string) {
 	}
 }
 
-func listRemoteCmd(rr *ftl.RemoteRepository, packageName string) error {
+func formatMeta(meta ftl.RevisionMeta) string {
+	fields := make([]string, 0, len(meta))
+	for _, key := range meta.Keys() {
+		fields = append(fields, fmt.Sprintf("%s=%s", key, meta[key]))
+	}
+	return strings.Join(fields, " ")
+}
+
+func showCmd(rr *ftl.RemoteRepository, revision *ftl.RevisionInfo) error {
+	meta, err := rr.GetRevisionMeta(revision)
+	if err != nil {
+		return err
+	}
+
+	tags, err := rr.TagsFor(revision)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(revision.Name())
+	if len(tags) > 0 {
+		fmt.Printf("  tags: %s\n", strings.Join(tags, ", "))
+	}
+	if meta == nil {
+		fmt.Println("  (no metadata recorded)")
+	}
+	for _, key := range meta.Keys() {
+		fmt.Printf("  %s: %s\n", key, meta[key])
+	}
+	return nil
+}
+
+// rollbackCmd activates an earlier revision on this host. The next sync
+// jumps back to master's current revision, so say so if that's different.
+func rollbackCmd(remote *ftl.RemoteRepository, local *ftl.LocalRepository, packageName string, steps int) error {
+	revision, err := local.Rollback(packageName, steps)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Rolled back to", revision.Name())
+
+	masterRevision, err := remote.GetCurrentRevision(packageName)
+	if err != nil {
+		fmt.Println("Failed to check master:", err)
+		return nil
+	}
+
+	if masterRevision != nil && *masterRevision != *revision {
+		fmt.Printf("Warning: master is at %s, the next sync will jump back to it\n", masterRevision.Name())
+	}
+	return nil
+}
+
+func hooksCmd(lr *ftl.LocalRepository, revision *ftl.RevisionInfo) error {
+	found := false
+	for _, localRevision := range lr.ListRevisions(revision.PackageName) {
+		if *localRevision == *revision {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("Revision %s isn't installed", revision.Name())
+	}
+
+	scripts, err := lr.FindHooks(revision)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(revision.Name())
+	for _, hook := range ftl.PKG_HOOKS {
+		var running string
+		hasScript := false
+		for _, script := range scripts {
+			if script.Hook != hook {
+				continue
+			}
+			hasScript = true
+
+			var status string
+			switch {
+			case script.Runs && !script.Exists:
+				status = "declared, but missing"
+			case script.Runs && !script.Executable:
+				status = "runs, but isn't executable"
+			case script.Runs:
+				status = "runs"
+			default:
+				status = "skipped for " + running
+			}
+			if script.Runs {
+				running = script.Path
+			}
+
+			command := strings.Join(append([]string{script.Path}, script.Args...), " ")
+			fmt.Printf("  %-12s %-24s %s\n", hook, command, status)
+		}
+
+		if !hasScript {
+			fmt.Printf("  %-12s %-24s\n", hook, "(none)")
+		}
+	}
+	return nil
+}
+
+func formatHistoryEntry(entry *ftl.HistoryEntry) string {
+	var change string
+	switch {
+	case entry.From != "" && entry.To != "":
+		change = entry.From + " -> " + entry.To
+	case entry.To != "":
+		change = entry.To
+	default:
+		change = entry.From
+	}
+
+	who := entry.User
+	if entry.SudoUser != "" {
+		who = fmt.Sprintf("%s (sudo from %s)", entry.User, entry.SudoUser)
+	}
+	if entry.Trigger != "" {
+		who += " via " + entry.Trigger
+	}
+
+	line := fmt.Sprintf("%s  %-9s %s  by %s", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Action, change, who)
+	for _, hook := range entry.Hooks {
+		line += fmt.Sprintf("\n    %s %s: %s", hook.Revision, hook.Hook, hook.Status)
+	}
+	if entry.Error != "" {
+		line += "\n    failed: " + entry.Error
+	}
+	return line
+}
+
+func formatAuditEntry(entry *ftl.AuditEntry) string {
+	change := entry.Revision
+	switch {
+	case entry.Action == ftl.AUDIT_TAG && entry.Previous != "":
+		change = fmt.Sprintf("%s %s (from %s)", entry.Tag, entry.Revision, entry.Previous)
+	case entry.Action == ftl.AUDIT_TAG:
+		change = entry.Tag + " " + entry.Revision
+	case entry.Previous != "":
+		change = entry.Previous + " -> " + entry.Revision
+	}
+
+	channel := entry.Channel
+	if channel == "" {
+		channel = "(default)"
+	}
+
+	line := fmt.Sprintf("%s  %-9s %-9s %s  by %s on %s", entry.Time.Local().Format("2006-01-02 15:04:05"), channel, entry.Action, change, entry.User, entry.Host)
+	if entry.Message != "" {
+		line += "\n    " + entry.Message
+	}
+	return line
+}
+
+func masterHistoryCmd(rr *ftl.RemoteRepository, packageName string) error {
+	entries, err := rr.AuditHistory(packageName)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fmt.Println(formatAuditEntry(entry))
+	}
+	return nil
+}
+
+func historyCmd(lr *ftl.LocalRepository, packageName string) error {
+	entries, err := lr.History(packageName)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fmt.Println(formatHistoryEntry(entry))
+	}
+	return nil
+}
+
+func listRemoteCmd(rr *ftl.RemoteRepository, packageName string, long bool) error {
 	activeRev, err := rr.GetCurrentRevision(packageName)
 	if err != nil {
 		return err
@@ -280,11 +784,20 @@ func listRemoteCmd(rr *ftl.RemoteRepository, packageName string) error {
 	}
 
 	for _, revision := range revisionList {
+		line := revision.Name()
 		if activeRev != nil && *activeRev == *revision {
-			fmt.Printf("%s\t(active)\n", revision.Name())
-		} else {
-			fmt.Println(revision.Name())
+			line += "\t(active)"
 		}
+
+		if long {
+			meta, err := rr.GetRevisionMeta(revision)
+			if err != nil {
+				return err
+			}
+			line += "\t" + formatMeta(meta)
+		}
+
+		fmt.Println(line)
 	}
 
 	return nil
@@ -307,11 +820,30 @@ func listRemotePackagesCmd(remote *ftl.RemoteRepository) error {
 	return nil
 }
 
+func migrateRemoteCmd(remote *ftl.RemoteRepository, packageNames []string, dryRun bool) error {
+	if len(packageNames) == 0 {
+		var err error
+		packageNames, err = remote.ListPackages()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, packageName := range packageNames {
+		err := remote.Migrate(packageName, dryRun)
+		if err != nil {
+			return fmt.Errorf("Failed to migrate %s: %v", packageName, err)
+		}
+	}
+	return nil
+}
+
 func main() {
 	goopt.Description = func() string {
 		return "Faster Than Light Deploy System"
 	}
 	goopt.Version = Version
+	ftl.Version = Version
 	goopt.Summary = "Deploy system built around S3."
 	goopt.Parse(nil)
 
@@ -339,32 +871,90 @@ func main() {
 		optFail(fmt.Sprintf("FTL_BUCKET not set"))
 	}
 
-	remote := ftl.NewRemoteRepository(ftlBucketEnv, auth, optToRegion(os.Getenv("AWS_DEFAULT_REGION")))
+	ftlChannelEnv := os.Getenv("FTL_CHANNEL")
+	if !ftl.ValidChannelName(ftlChannelEnv) {
+		optFail(fmt.Sprintf("Invalid FTL_CHANNEL: %s", ftlChannelEnv))
+	}
+
+	remote := ftl.NewRemoteRepository(ftlBucketEnv, os.Getenv("FTL_PREFIX"), auth, optToRegion(os.Getenv("AWS_DEFAULT_REGION"))).Channel(ftlChannelEnv)
+	remote.Message = *auditMessage
 	local := ftl.NewLocalRepository(ftlRoot)
 
+	if ftlHookTimeoutEnv := os.Getenv("FTL_HOOK_TIMEOUT"); ftlHookTimeoutEnv != "" {
+		local.ScriptTimeout, err = time.ParseDuration(ftlHookTimeoutEnv)
+		if err != nil {
+			optFail(fmt.Sprintf("Invalid FTL_HOOK_TIMEOUT: %v", err))
+		}
+	}
+
 	if len(goopt.Args) > 0 {
 		cmd := strings.TrimSpace(goopt.Args[0])
+		local.Trigger = cmd
 		switch cmd {
 		case "spool":
 			if len(goopt.Args) > 1 {
-				fileName := strings.TrimSpace(goopt.Args[1])
-				fullPath, e := filepath.Abs(fileName)
+				source := strings.TrimSpace(goopt.Args[1])
+				if source != "-" {
+					fullPath, e := filepath.Abs(source)
+					if e != nil {
+						optFail("Unable to parse path")
+					}
+					source = fullPath
+				}
+
+				meta, e := parseMetaOpts(*metaOpts, source)
 				if e != nil {
-					optFail("Unable to parse path")
+					optFail(e.Error())
 				}
 
-				err = spoolCmd(remote, fullPath)
+				err = spoolCmd(remote, source, *packageOpt, meta)
 			} else {
 				optFail("Missing file name")
 			}
+		case "release":
+			if len(goopt.Args) < 2 {
+				optFail("Missing file name")
+			}
+
+			source := strings.TrimSpace(goopt.Args[1])
+			if source != "-" {
+				fullPath, e := filepath.Abs(source)
+				if e != nil {
+					optFail("Unable to parse path")
+				}
+				source = fullPath
+			}
+
+			meta, e := parseMetaOpts(*metaOpts, source)
+			if e != nil {
+				optFail(e.Error())
+			}
+
+			timeout, e := time.ParseDuration(*releaseTimeout)
+			if e != nil {
+				optFail(fmt.Sprintf("Invalid timeout: %v", e))
+			}
+
+			if *releaseWaitPercent < 1 || *releaseWaitPercent > 100 {
+				optFail("--wait-percent must be between 1 and 100")
+			}
+
+			var hosts []string
+			for _, host := range strings.Split(*releaseHosts, ",") {
+				if host = strings.TrimSpace(host); host != "" {
+					hosts = append(hosts, host)
+				}
+			}
+
+			err = releaseCmd(remote, source, *packageOpt, meta, *releaseTag, hosts, *releaseWaitPercent, timeout)
 		case "jump":
 			if len(goopt.Args) > 1 {
-				revision := ftl.NewRevisionInfo(strings.TrimSpace(goopt.Args[1]))
+				revision, e := remote.ResolveRevision(strings.TrimSpace(goopt.Args[1]))
 
-				if revision == nil {
-					optFail("Invalid revision name")
+				if e != nil {
+					err = e
 				} else if *amMaster {
-					err = remote.Jump(revision)
+					err = remote.Jump(revision, *amForce)
 				} else {
 					err = local.Jump(revision)
 				}
@@ -385,7 +975,7 @@ func main() {
 		case "list":
 			if len(goopt.Args) > 1 {
 				if *amMaster {
-					err = listRemoteCmd(remote, strings.TrimSpace(goopt.Args[1]))
+					err = listRemoteCmd(remote, strings.TrimSpace(goopt.Args[1]), *amLong)
 				} else {
 					listCmd(local, strings.TrimSpace(goopt.Args[1]))
 				}
@@ -396,18 +986,90 @@ func main() {
 					listPackagesCmd(local)
 				}
 			}
+		case "tag":
+			if len(goopt.Args) < 3 {
+				optFail("Must specify revision and tag")
+			}
+
+			revision, e := remote.ResolveRevision(strings.TrimSpace(goopt.Args[1]))
+			if e != nil {
+				err = e
+			} else if *amMaster {
+				err = remote.Tag(revision, strings.TrimSpace(goopt.Args[2]))
+			} else {
+				optFail("I only know how to tag master")
+			}
+		case "show":
+			if len(goopt.Args) < 2 {
+				optFail("Must specify revision to show")
+			}
+
+			revision, e := remote.ResolveRevision(strings.TrimSpace(goopt.Args[1]))
+			if e != nil {
+				err = e
+			} else {
+				err = showCmd(remote, revision)
+			}
 		case "sync":
-			err = syncCmd(remote, local)
+			err = syncCmd(remote, local, *syncKeep)
+		case "history":
+			if len(goopt.Args) < 2 {
+				optFail("Package name required")
+			}
+
+			if *amMaster {
+				err = masterHistoryCmd(remote, strings.TrimSpace(goopt.Args[1]))
+			} else {
+				err = historyCmd(local, strings.TrimSpace(goopt.Args[1]))
+			}
+		case "rollback":
+			if len(goopt.Args) < 2 {
+				optFail("Package name required")
+			}
+
+			err = rollbackCmd(remote, local, strings.TrimSpace(goopt.Args[1]), *rollbackSteps)
+		case "hooks":
+			if len(goopt.Args) < 2 {
+				optFail("Must specify revision")
+			}
+
+			revision, e := remote.ResolveRevision(strings.TrimSpace(goopt.Args[1]))
+			if e != nil {
+				err = e
+			} else {
+				err = hooksCmd(local, revision)
+			}
+		case "promote":
+			if len(goopt.Args) < 2 {
+				optFail("Must specify revision to promote")
+			}
+
+			if !ftl.ValidChannelName(*fromChannel) || !ftl.ValidChannelName(*toChannel) {
+				optFail("Invalid channel name")
+			}
+
+			revision, e := remote.ResolveRevision(strings.TrimSpace(goopt.Args[1]))
+			if e != nil {
+				err = e
+			} else {
+				err = remote.Promote(revision, *fromChannel, *toChannel)
+			}
+		case "migrate":
+			if *amMaster {
+				err = migrateRemoteCmd(remote, goopt.Args[1:], *amDryRun)
+			} else {
+				optFail("I only know how to migrate master")
+			}
 		case "purge":
 			if len(goopt.Args) < 2 {
 				optFail("Must specify revision to purge")
 			}
 
-			revision := ftl.NewRevisionInfo(strings.TrimSpace(goopt.Args[1]))
-			if revision == nil {
-				optFail("Invalid revision name")
+			revision, e := remote.ResolveRevision(strings.TrimSpace(goopt.Args[1]))
+			if e != nil {
+				err = e
 			} else if *amMaster {
-				err = remote.PurgeRevision(revision)
+				err = remote.PurgeRevision(revision, *amForce)
 			} else {
 				optFail("I only know how to purge master")
 			}
@@ -422,8 +1084,10 @@ func main() {
 	if err != nil {
 		fmt.Println(err)
 
-		if pse, ok := err.(*ftl.PackageScriptError); ok {
+		if pse, ok := err.(*ftl.PackageScriptError); ok && !pse.TimedOut {
 			os.Exit(pse.WaitStatus.ExitStatus())
+		} else if _, ok := err.(*ftl.HealthCheckError); ok {
+			os.Exit(HEALTHCHECK_EXIT_STATUS)
 		} else {
 			os.Exit(1)
 		}
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"github.com/rhettg/ftl/ftl"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goamz/s3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_syncPackage_downNone(t *testing.T) {
@@ -195,3 +204,227 @@ func Test_syncPackage_purgeAll(t *testing.T) {
 		t.Error("Expected purge 001")
 	}
 }
+
+func Test_keepRecent(t *testing.T) {
+	purge := []*ftl.RevisionInfo{
+		{"test", "001"},
+		{"test", "002"},
+		{"test", "003"},
+	}
+
+	recent := []*ftl.RevisionInfo{
+		{"test", "004"},
+		{"test", "002"},
+	}
+
+	remaining := keepRecent(purge, recent)
+	if len(remaining) != 2 {
+		t.Error("Expected 2 purges", remaining)
+	}
+
+	if remaining[0].Revision != "001" || remaining[1].Revision != "003" {
+		t.Error("Expected to keep 002")
+	}
+}
+
+// memBucket keeps objects in memory. listed is called before each listing,
+// letting tests act as hosts checking in.
+type memBucket struct {
+	objects map[string][]byte
+	listed  func(prefix string)
+}
+
+func (b *memBucket) Get(path string) ([]byte, error) {
+	data, ok := b.objects[path]
+	if !ok {
+		return nil, &s3.Error{StatusCode: 404, Code: "NoSuchKey"}
+	}
+	return data, nil
+}
+
+func (b *memBucket) GetReader(path string) (io.ReadCloser, error) {
+	data, err := b.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *memBucket) Put(path string, data []byte, contType string, perm s3.ACL) error {
+	b.objects[path] = data
+	return nil
+}
+
+func (b *memBucket) PutReader(path string, r io.Reader, length int64, contType string, perm s3.ACL) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.objects[path] = data
+	return nil
+}
+
+func (b *memBucket) Del(path string) error {
+	delete(b.objects, path)
+	return nil
+}
+
+func (b *memBucket) List(prefix, delim, marker string, max int) (*s3.ListResp, error) {
+	if b.listed != nil {
+		b.listed(prefix)
+	}
+
+	keys := []string{}
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	resp := &s3.ListResp{Prefix: prefix, Marker: marker, MaxKeys: max}
+	for _, key := range keys {
+		if len(resp.Contents) >= max {
+			resp.IsTruncated = true
+			break
+		}
+		resp.Contents = append(resp.Contents, s3.Key{Key: key, Size: int64(len(b.objects[key]))})
+	}
+	return resp, nil
+}
+
+func newTestRemote() (*ftl.RemoteRepository, *memBucket) {
+	bucket := &memBucket{objects: make(map[string][]byte)}
+	return ftl.NewRemoteRepositoryWithBucket(bucket, ""), bucket
+}
+
+// testPackageDir makes a package directory whose content is unique to data.
+func testPackageDir(t *testing.T, data string) string {
+	dir, err := ioutil.TempDir("", "ftl-release")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "data"), []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func Test_waitForHosts(t *testing.T) {
+	releasePollInterval = time.Millisecond
+	remote, _ := newTestRemote()
+	revision := &ftl.RevisionInfo{"test", "002bb"}
+	since := time.Now().Add(-time.Minute)
+
+	remote.CheckIn("test", "web1", revision, nil)
+	remote.CheckIn("test", "web2", revision, nil)
+	remote.CheckIn("test", "web3", &ftl.RevisionInfo{"test", "001aa"}, nil)
+
+	hosts := []string{"web1", "web2", "web3"}
+	err := waitForHosts(remote, revision, hosts, since, 66, 0)
+	if err != nil {
+		t.Error("Expected 2 of 3 hosts to be enough", err)
+	}
+
+	err = waitForHosts(remote, revision, hosts, since, 67, 0)
+	if err == nil {
+		t.Error("Expected 2 of 3 hosts not to be enough")
+	}
+
+	err = waitForHosts(remote, revision, append(hosts, "web4"), since, 100, 0)
+	if err == nil || !strings.Contains(err.Error(), "1 of 4 hosts never checked in") {
+		t.Error("Expected web4 to be reported as never checking in", err)
+	}
+}
+
+func Test_waitForHosts_failed(t *testing.T) {
+	releasePollInterval = time.Millisecond
+	remote, _ := newTestRemote()
+	revision := &ftl.RevisionInfo{"test", "002bb"}
+
+	remote.CheckIn("test", "web1", &ftl.RevisionInfo{"test", "001aa"}, revision)
+
+	// Doesn't wait out the timeout once a host has given up on the revision
+	err := waitForHosts(remote, revision, []string{"web1"}, time.Now().Add(-time.Minute), 100, time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "web1 failed its health check") {
+		t.Error("Expected health check failure", err)
+	}
+}
+
+func Test_releaseCmd(t *testing.T) {
+	releasePollInterval = time.Millisecond
+	remote, bucket := newTestRemote()
+
+	dir := testPackageDir(t, "v1")
+	defer os.RemoveAll(dir)
+
+	err := releaseCmd(remote, dir, "test", nil, "v1", nil, 100, 0)
+	if err != nil {
+		t.Fatal("Error from releaseCmd", err)
+	}
+
+	revision, err := remote.GetCurrentRevision("test")
+	if err != nil || revision == nil {
+		t.Fatal("Expected a current revision", err)
+	}
+
+	tagged, err := remote.ResolveRevision("test@v1")
+	if err != nil || *tagged != *revision {
+		t.Error("Expected release to be tagged", tagged, err)
+	}
+
+	// web1 picks up whatever master points at once release starts waiting
+	bucket.listed = func(prefix string) {
+		if strings.HasPrefix(prefix, "test.checkin/") {
+			current, _ := remote.GetCurrentRevision("test")
+			remote.CheckIn("test", "web1", current, nil)
+		}
+	}
+
+	dir2 := testPackageDir(t, "v2")
+	defer os.RemoveAll(dir2)
+
+	err = releaseCmd(remote, dir2, "test", nil, "", []string{"web1", "web2"}, 50, time.Minute)
+	if err != nil {
+		t.Fatal("Error from releaseCmd", err)
+	}
+
+	current, err := remote.GetCurrentRevision("test")
+	if err != nil || current == nil || *current == *revision {
+		t.Error("Expected master to stay on the new revision", current, err)
+	}
+}
+
+func Test_releaseCmd_jumpBack(t *testing.T) {
+	releasePollInterval = time.Millisecond
+	remote, _ := newTestRemote()
+
+	dir := testPackageDir(t, "v1")
+	defer os.RemoveAll(dir)
+
+	err := releaseCmd(remote, dir, "test", nil, "", nil, 100, 0)
+	if err != nil {
+		t.Fatal("Error from releaseCmd", err)
+	}
+
+	revision, err := remote.GetCurrentRevision("test")
+	if err != nil || revision == nil {
+		t.Fatal("Expected a current revision", err)
+	}
+
+	dir2 := testPackageDir(t, "v2")
+	defer os.RemoveAll(dir2)
+
+	// web1 never checks in
+	err = releaseCmd(remote, dir2, "test", nil, "", []string{"web1"}, 100, 0)
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Error("Expected release to time out", err)
+	}
+
+	current, err := remote.GetCurrentRevision("test")
+	if err != nil || current == nil || *current != *revision {
+		t.Error("Expected master to jump back", current, err)
+	}
+}